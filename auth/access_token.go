@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes"
+	"time"
+)
+
+// REVOKED_ACCESS_TOKEN_TICKET records the ids of revoked JWT access tokens until they expire, since such tokens are
+// verified without the token store.
+const REVOKED_ACCESS_TOKEN_TICKET = "revoked_access_token"
+
+var (
+	jwtAccessTokens = false
+)
+
+// EnableJWTAccessTokens switches access tokens from opaque random strings to JWTs signed with the current signing key.
+// Such tokens can be verified without a token store lookup, by this server as well as by any other service that fetches
+// the public keys from the JWKS endpoint.
+func EnableJWTAccessTokens() {
+	jwtAccessTokens = true
+}
+
+// accessTokenClaims are the claims of a JWT access token, carrying the same information as the corresponding AuthToken.
+type accessTokenClaims struct {
+	Id              string             `json:"jti"`
+	ClientId        string             `json:"client_id"`
+	UserId          string             `json:"sub,omitempty"`
+	Scope           string             `json:"scope,omitempty"`
+	IssuedAt        int64              `json:"iat"`
+	Expiration      int64              `json:"exp"`
+	Actor           *actorClaim        `json:"act,omitempty"`
+	SubjectClientId string             `json:"subject_client_id,omitempty"`
+	Confirmation    *confirmationClaim `json:"cnf,omitempty"`
+}
+
+// actorClaim identifies the client that acts on behalf of the subject, as in RFC 8693.
+type actorClaim struct {
+	ClientId string `json:"client_id"`
+}
+
+// confirmationClaim binds the token to the client certificate it was issued over, as in RFC 8705.
+type confirmationClaim struct {
+	CertificateThumbprint string `json:"x5t#S256"`
+}
+
+// issueAccessToken sets the access token and its creation and expiration times, and binds it to the client certificate
+// of the connection, if any. All other fields that go into a JWT access token need to be set before calling it.
+func issueAccessToken(ctx context.Context, authToken *AuthToken, now time.Time, expiration time.Duration) error {
+	var err error
+	authToken.CertificateThumbprint = peerCertificateThumbprint(ctx)
+	authToken.AccessCreationTime, err = ptypes.TimestampProto(now)
+	if err != nil {
+		return err
+	}
+	authToken.AccessExpirationTime, err = ptypes.TimestampProto(now.Add(expiration))
+	if err != nil {
+		return err
+	}
+
+	id, err := generateToken()
+	if err != nil {
+		return err
+	}
+	if !jwtAccessTokens {
+		authToken.Access = id
+		return nil
+	}
+
+	key, err := keys.signingKey()
+	if err != nil {
+		return err
+	}
+
+	claims := accessTokenClaims{
+		Id:         id,
+		ClientId:   authToken.ClientId,
+		UserId:     authToken.UserId,
+		Scope:      scopeString(authToken.Scope),
+		IssuedAt:   now.Unix(),
+		Expiration: now.Add(expiration).Unix(),
+	}
+	if authToken.ActorClientId != "" {
+		claims.Actor = &actorClaim{authToken.ActorClientId}
+		claims.SubjectClientId = authToken.SubjectClientId
+	}
+	if authToken.CertificateThumbprint != "" {
+		claims.Confirmation = &confirmationClaim{authToken.CertificateThumbprint}
+	}
+	authToken.Access, err = signJWT(jwtHeader{Kid: key.Id}, &claims, key.PrivateKey)
+	return err
+}
+
+func parseAccessToken(token string) (*AuthToken, error) {
+	var claims accessTokenClaims
+	if err := parseJWT(token, keys.keyFunc, &claims); err != nil {
+		return nil, err
+	}
+
+	var err error
+	authToken := AuthToken{ClientId: claims.ClientId, UserId: claims.UserId, SubjectClientId: claims.SubjectClientId, Access: token}
+	if claims.Actor != nil {
+		authToken.ActorClientId = claims.Actor.ClientId
+	}
+	if claims.Confirmation != nil {
+		authToken.CertificateThumbprint = claims.Confirmation.CertificateThumbprint
+	}
+	authToken.Scope, err = ParseScope(claims.Scope)
+	if err != nil {
+		return nil, err
+	}
+	authToken.AccessCreationTime, err = ptypes.TimestampProto(time.Unix(claims.IssuedAt, 0))
+	if err != nil {
+		return nil, err
+	}
+	authToken.AccessExpirationTime, err = ptypes.TimestampProto(time.Unix(claims.Expiration, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &authToken, nil
+}
+
+// denyAccessToken adds a JWT access token to the tickets of revoked tokens. Opaque tokens are only valid while they are
+// in the token store, and need no such record.
+func denyAccessToken(token string) error {
+	if !isJWT(token) {
+		return nil
+	}
+	var claims accessTokenClaims
+	if err := peekJWTClaims(token, &claims); err != nil {
+		return err
+	}
+	expirationTime := time.Unix(claims.Expiration, 0)
+	if !time.Now().Before(expirationTime) {
+		return nil
+	}
+	return ticketStore.Put(REVOKED_ACCESS_TOKEN_TICKET, claims.Id, nil, expirationTime)
+}
+
+// checkAccessTokenDenied returns ErrTokenNotFound if a JWT access token has been revoked. The token must have been
+// verified already.
+func checkAccessTokenDenied(token string) error {
+	var claims accessTokenClaims
+	if err := peekJWTClaims(token, &claims); err != nil {
+		return ErrTokenNotFound
+	}
+	if _, err := ticketStore.Get(REVOKED_ACCESS_TOKEN_TICKET, claims.Id); err == nil {
+		return ErrTokenNotFound
+	} else if err != ErrTicketNotFound {
+		return err
+	}
+	return nil
+}
@@ -3,17 +3,22 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"math"
 	"strings"
+	"time"
 )
 
 var (
-	tokenStore        = make(map[string]AuthToken)
-	refreshTokenStore = make(map[string]AuthToken)
+	tokenStore TokenStore = NewMemoryTokenStore()
 )
 
 type authorizable interface {
@@ -62,47 +67,157 @@ func generateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-func addAuthToken(authToken AuthToken) {
-	tokenStore[authToken.Access] = authToken
-	if authToken.Refresh != "" {
-		refreshTokenStore[authToken.Refresh] = authToken
+func SetTokenStore(store TokenStore) {
+	tokenStore = store
+}
+
+func addAuthToken(authToken AuthToken) error {
+	return tokenStore.Add(authToken)
+}
+
+// removeAuthToken revokes the access token, along with its refresh token. JWT access tokens are denied before they are
+// removed from the token store, so that a failure leaves the token revocable once more.
+func removeAuthToken(authToken AuthToken) error {
+	if err := denyAccessToken(authToken.Access); err != nil {
+		return err
+	}
+	return tokenStore.Revoke(authToken.Access)
+}
+
+func getRefreshAuthToken(refresh string) (*AuthToken, error) {
+	return tokenStore.GetByRefresh(refresh)
+}
+
+func createTokenResponse(authToken *AuthToken) (*CreateTokenResponse, error) {
+	return createTokenResponseWithNonce(authToken, "")
+}
+
+func createTokenResponseWithNonce(authToken *AuthToken, nonce string) (*CreateTokenResponse, error) {
+	var err error
+	resp := CreateTokenResponse{TokenType: "bearer", AccessToken: authToken.Access, RefreshToken: authToken.Refresh}
+
+	resp.Scope = scopeString(authToken.Scope)
+
+	t, err := ptypes.Timestamp(authToken.AccessExpirationTime)
+	if err != nil {
+		return nil, err
+	}
+	resp.ExpiresIn = int32(math.Ceil(t.Sub(time.Now()).Seconds()))
+
+	if resp.IdToken, err = issueIdToken(authToken, nonce); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func isExpired(t *timestamp.Timestamp, now time.Time) bool {
+	if t == nil {
+		return false
 	}
+	expiration, err := ptypes.Timestamp(t)
+	return err != nil || !now.Before(expiration)
 }
 
-func extractAuthToken(ctx context.Context) *AuthToken {
+func extractAuthToken(ctx context.Context) (*AuthToken, error) {
 	var err error
 	var token string
 	token, err = grpc_auth.AuthFromMD(ctx, "bearer")
 	if err != nil {
-		return nil
+		return nil, nil
 	}
-	authToken, ok := tokenStore[token]
-	if !ok {
-		return nil
+	authToken, err := verifyAccessToken(token)
+	if err == ErrTokenNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	return &authToken
+	// Certificate-bound tokens are useless to anyone who obtains them without the private key of the certificate.
+	if authToken.CertificateThumbprint != "" && authToken.CertificateThumbprint != peerCertificateThumbprint(ctx) {
+		return nil, status.Error(codes.Unauthenticated, "Access token bound to a different certificate")
+	}
+	return authToken, nil
 }
 
-func getAuthToken(access string) AuthToken {
-	return tokenStore[access]
+// verifyAccessToken returns the AuthToken of a valid access token, or ErrTokenNotFound if the token is unknown, revoked
+// or cannot be verified.
+func verifyAccessToken(token string) (*AuthToken, error) {
+	var err error
+	var authToken *AuthToken
+	if jwtAccessTokens && isJWT(token) {
+		if authToken, err = parseAccessToken(token); err != nil {
+			return nil, ErrTokenNotFound
+		}
+		if err := checkAccessTokenDenied(token); err == ErrTokenNotFound {
+			return nil, ErrTokenNotFound
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, "Unable to verify access token")
+		}
+	} else if authToken, err = tokenStore.Get(token); err != nil {
+		return nil, ErrTokenNotFound
+	}
+	if isExpired(authToken.AccessExpirationTime, time.Now()) {
+		return nil, status.Error(codes.Unauthenticated, "Access token expired")
+	}
+	return authToken, nil
 }
 
-func HasScope(scope Scope, authToken *AuthToken) bool {
-	if authToken != nil {
-		for _, s := range authToken.Scope {
-			if s == scope {
-				return true
-			}
+func getAuthToken(access string) (*AuthToken, error) {
+	return tokenStore.Get(access)
+}
+
+func containsScope(scopes []Scope, scope Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
 		}
 	}
 	return false
 }
 
+func HasScope(scope Scope, authToken *AuthToken) bool {
+	return authToken != nil && containsScope(authToken.Scope, scope)
+}
+
+func scopeString(scope []Scope) string {
+	var scopeNames []string
+	for _, s := range scope {
+		scopeNames = append(scopeNames, Scope_name[int32(s)])
+	}
+	return strings.Join(scopeNames, " ")
+}
+
+func ParseScope(s string) ([]Scope, error) {
+	var scope []Scope
+	for _, name := range strings.Fields(s) {
+		if value, ok := Scope_value[name]; ok {
+			scope = append(scope, Scope(value))
+		} else {
+			return nil, fmt.Errorf("Unknown scope %s", name)
+		}
+	}
+	return scope, nil
+}
+
 func GetAuthToken(ctx context.Context) (*AuthToken, bool) {
 	authToken, ok := ctx.Value("token").(*AuthToken)
 	return authToken, ok
 }
 
+// tagAuthToken adds the identities behind the token to the request log, including the acting client of exchanged tokens
+// and the client that the user token was exchanged from.
+func tagAuthToken(ctx context.Context, authToken *AuthToken) {
+	tags := grpc_ctxtags.Extract(ctx)
+	tags.Set("auth.client_id", authToken.ClientId)
+	if authToken.UserId != "" {
+		tags.Set("auth.user_id", authToken.UserId)
+	}
+	if authToken.ActorClientId != "" {
+		tags.Set("auth.actor_client_id", authToken.ActorClientId)
+		tags.Set("auth.subject_client_id", authToken.SubjectClientId)
+	}
+}
+
 func StreamServerInterceptor() grpc.StreamServerInterceptor {
 	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 		wrapper := &streamWrapper{stream}
@@ -112,9 +227,13 @@ func StreamServerInterceptor() grpc.StreamServerInterceptor {
 
 func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		token := extractAuthToken(ctx)
+		token, err := extractAuthToken(ctx)
+		if err != nil {
+			return nil, err
+		}
 		if token != nil {
 			ctx = context.WithValue(ctx, "token", token)
+			tagAuthToken(ctx, token)
 		}
 		if auth, ok := req.(authorizable); ok {
 			if err := auth.Authorize(ctx); err != nil {
@@ -126,13 +245,35 @@ func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 }
 
 type AuthService struct {
-	GrantTypeHandlers map[string]GrantTypeHandler
+	GrantTypeHandlers     map[string]GrantTypeHandler
+	ClientStore           clientStore
+	ClientRegistry        clientRegistry
+	UserStore             userStore
+	RegistrationScopes    []Scope // Scopes that dynamically registered clients may request
+	DeviceVerificationUri string  // Where users enter the user codes of the device authorization grant
+	TokenEndpoint         string  // The audience that JWT assertions must be issued for
+}
+
+func (c *AuthService) GetJwks(ctx context.Context, r *GetJwksRequest) (*Jwks, error) {
+	signingKeys, err := keys.list(false)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to load keys")
+	}
+	var jwks Jwks
+	for i := len(signingKeys) - 1; i >= 0; i-- {
+		jwks.Keys = append(jwks.Keys, newJwk(signingKeys[i]))
+	}
+	return &jwks, nil
 }
 
 func (c *AuthService) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
-	if handler, ok := c.GrantTypeHandlers[r.GrantType]; ok {
-		return handler.CreateToken(ctx, r)
-	} else {
+	handler, ok := c.GrantTypeHandlers[r.GrantType]
+	if !ok {
 		return nil, status.Error(codes.InvalidArgument, "Unknown grant type")
 	}
+	// Checked here for all grant types at once, so that no handler can forget it.
+	if err := checkGrantType(ctx, c.ClientStore, r); err != nil {
+		return nil, err
+	}
+	return handler.CreateToken(ctx, r)
 }
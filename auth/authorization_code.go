@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/url"
+	"time"
+)
+
+const (
+	AUTHORIZATION_CODE_EXPIRATION = time.Minute * 5
+	AUTHORIZATION_CODE_TICKET     = "authorization_code"
+)
+
+func getRedirectUri(clientInfo *ClientInfo, redirectUri string) (string, error) {
+	if redirectUri == "" {
+		if len(clientInfo.RedirectUris) == 1 {
+			return clientInfo.RedirectUris[0], nil
+		}
+		return "", status.Error(codes.InvalidArgument, "Missing redirect uri")
+	}
+	// Redirect uris are compared exactly, so that codes cannot be sent anywhere the client did not register.
+	for _, u := range clientInfo.RedirectUris {
+		if u == redirectUri {
+			return redirectUri, nil
+		}
+	}
+	return "", status.Error(codes.InvalidArgument, "Unregistered redirect uri")
+}
+
+func appendQuery(redirectUri string, code string, state string) (string, error) {
+	u, err := url.Parse(redirectUri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("code", code)
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Authorize implements the authorization endpoint of RFC 6749 for the "code" response type. The user approves the
+// client with their own access token, and the returned code is bound to the client, the redirect uri and the PKCE code
+// challenge (RFC 7636), which is required from every client.
+func (c *AuthService) Authorize(ctx context.Context, r *AuthorizeRequest) (*AuthorizeResponse, error) {
+	userAuthToken, ok := GetAuthToken(ctx)
+	if !ok || userAuthToken.UserId == "" {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated as a user")
+	}
+
+	if r.ResponseType != "code" {
+		return nil, status.Error(codes.InvalidArgument, "Unsupported response type")
+	}
+
+	clientInfo, err := c.ClientStore.GetClientInfo(r.ClientId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Unknown client")
+	}
+	if !clientInfo.allowsGrantType(GrantType_authorization_code.String()) {
+		return nil, status.Error(codes.PermissionDenied, "Grant type not allowed for client")
+	}
+	redirectUri, err := getRedirectUri(clientInfo, r.RedirectUri)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.CodeChallenge == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing code challenge")
+	}
+	method := r.CodeChallengeMethod
+	if method == "" {
+		method = "plain"
+	}
+	if method != "S256" && method != "plain" {
+		return nil, status.Error(codes.InvalidArgument, "Unsupported code challenge method")
+	}
+
+	scope, err := ParseScope(r.Scope)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if scope, err = grantUserScope(scope, userAuthToken.Scope); err != nil {
+		return nil, err
+	}
+
+	code, err := generateToken()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate code")
+	}
+	// The redirect uri is only recorded if the request included it, in which case the token request must include the same
+	// one (RFC 6749 section 4.1.3).
+	authorizationCode := AuthorizationCode{
+		ClientId:            r.ClientId,
+		UserId:              userAuthToken.UserId,
+		RedirectUri:         r.RedirectUri,
+		Scope:               scope,
+		CodeChallenge:       r.CodeChallenge,
+		CodeChallengeMethod: method,
+		Nonce:               r.Nonce,
+	}
+	expirationTime := time.Now().Add(AUTHORIZATION_CODE_EXPIRATION)
+	if err := putTicket(AUTHORIZATION_CODE_TICKET, code, &authorizationCode, expirationTime); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store code")
+	}
+
+	location, err := appendQuery(redirectUri, code, r.State)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to build redirect uri")
+	}
+	return &AuthorizeResponse{Code: code, State: r.State, RedirectUri: location}, nil
+}
+
+func verifyCodeChallenge(authorizationCode *AuthorizationCode, verifier string) bool {
+	if verifier == "" {
+		return false
+	}
+	challenge := verifier
+	if authorizationCode.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(authorizationCode.CodeChallenge)) == 1
+}
+
+type AuthorizationCodeGrantTypeHandler struct {
+	ClientStore clientStore
+	UserStore   userStore
+}
+
+func (h *AuthorizationCodeGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, *AuthorizationCode, error) {
+	var err error
+	var authToken AuthToken
+	now := time.Now()
+
+	if r.GrantType != GrantType_authorization_code.String() {
+		return nil, nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
+	}
+
+	clientId, _, err := getClientCredentials(ctx, r.ClientId, r.ClientSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Codes are single use, so a failed attempt also burns the code.
+	var authorizationCode AuthorizationCode
+	if err := takeTicket(AUTHORIZATION_CODE_TICKET, r.Code, &authorizationCode); err == ErrTicketNotFound {
+		return nil, nil, status.Error(codes.Unauthenticated, "Invalid code")
+	} else if err != nil {
+		return nil, nil, status.Error(codes.Internal, "Unable to fetch code")
+	}
+	if authorizationCode.ClientId != clientId {
+		return nil, nil, status.Error(codes.Unauthenticated, "Invalid code")
+	}
+	if r.RedirectUri != authorizationCode.RedirectUri {
+		return nil, nil, status.Error(codes.Unauthenticated, "Invalid code")
+	}
+	if !verifyCodeChallenge(&authorizationCode, r.CodeVerifier) {
+		return nil, nil, status.Error(codes.Unauthenticated, "Invalid code verifier")
+	}
+
+	// Public clients rely on PKCE alone, while confidential clients also authenticate.
+	if _, _, err := identifyClient(ctx, h.ClientStore, r.ClientId, r.ClientSecret); err != nil {
+		return nil, nil, err
+	}
+
+	// The user may have been removed or had their scope reduced since the code was issued.
+	userInfo, err := h.UserStore.GetUserInfo(authorizationCode.UserId)
+	if err != nil {
+		return nil, nil, status.Error(codes.Unauthenticated, "Invalid code")
+	}
+	authToken.Scope = narrowUserScope(authorizationCode.Scope, userInfo)
+
+	authToken.ClientId = clientId
+	authToken.UserId = authorizationCode.UserId
+
+	if err := issueAccessToken(ctx, &authToken, now, USER_TOKEN_EXPIRATION); err != nil {
+		return nil, nil, err
+	}
+
+	authToken.Refresh, err = generateToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	authToken.RefreshExpirationTime, err = ptypes.TimestampProto(now.Add(REFRESH_TOKEN_EXPIRATION))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := addAuthToken(authToken); err != nil {
+		return nil, nil, status.Error(codes.Internal, "Unable to store token")
+	}
+
+	return &authToken, &authorizationCode, nil
+}
+
+func (h *AuthorizationCodeGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, authorizationCode, err := h.createAuthToken(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenResponseWithNonce(authToken, authorizationCode.Nonce)
+}
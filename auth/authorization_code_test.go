@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+const (
+	TEST_REDIRECT_URI   = "https://example.com/callback"
+	TEST_CODE_VERIFIER  = "dBjftJeZ4CVP-mJ92K1Q9pWdxlc7sOm0eqgP2OZY7Wk"
+	TEST_OTHER_VERIFIER = "4o1RjFc8kYw7i9bHyqPqO6Qx0W2hJ3vK5mNnLsTtUuV"
+)
+
+type authorizationCodeTest struct {
+	service *AuthService
+	handler *AuthorizationCodeGrantTypeHandler
+	userCtx context.Context
+}
+
+func newAuthorizationCodeTest(t *testing.T) *authorizationCodeTest {
+	SetTokenStore(NewMemoryTokenStore())
+	SetTicketStore(NewMemoryTicketStore())
+	clients := fakeClientStore{
+		"public":       &ClientInfo{RedirectUris: []string{TEST_REDIRECT_URI, "https://example.com/other"}},
+		"other":        &ClientInfo{RedirectUris: []string{TEST_REDIRECT_URI}},
+		"confidential": newConfidentialClient(t, "secret"),
+	}
+	clients["confidential"].RedirectUris = []string{TEST_REDIRECT_URI}
+	users := &fakeUserStore{passwords: map[string]string{"alice": ""}, scope: []Scope{Scope_user_profile}}
+	userToken := &AuthToken{ClientId: "browser", UserId: "alice", Scope: []Scope{Scope_user_profile}}
+	return &authorizationCodeTest{
+		service: &AuthService{ClientStore: clients},
+		handler: &AuthorizationCodeGrantTypeHandler{ClientStore: clients, UserStore: users},
+		userCtx: context.WithValue(context.Background(), "token", userToken),
+	}
+}
+
+func (a *authorizationCodeTest) authorize(t *testing.T, r *AuthorizeRequest) string {
+	r.ResponseType = "code"
+	r.Scope = "user_profile"
+	resp, err := a.service.Authorize(a.userCtx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Code
+}
+
+func (a *authorizationCodeTest) exchange(r *CreateTokenRequest) (*AuthToken, error) {
+	r.GrantType = GrantType_authorization_code.String()
+	authToken, _, err := a.handler.createAuthToken(context.Background(), r)
+	return authToken, err
+}
+
+func s256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestAuthorizationCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		authorize AuthorizeRequest
+		exchange  CreateTokenRequest
+		code      codes.Code
+	}{
+		{
+			"S256",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: s256(TEST_CODE_VERIFIER), CodeChallengeMethod: "S256"},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.OK,
+		},
+		{
+			"S256 with another verifier",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: s256(TEST_CODE_VERIFIER), CodeChallengeMethod: "S256"},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_OTHER_VERIFIER},
+			codes.Unauthenticated,
+		},
+		{
+			// The challenge must not be accepted as its own verifier.
+			"S256 with the challenge as verifier",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: s256(TEST_CODE_VERIFIER), CodeChallengeMethod: "S256"},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: s256(TEST_CODE_VERIFIER)},
+			codes.Unauthenticated,
+		},
+		{
+			"plain",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER, CodeChallengeMethod: "plain"},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.OK,
+		},
+		{
+			"plain by default",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.OK,
+		},
+		{
+			"plain with the hashed verifier",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER, CodeChallengeMethod: "plain"},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: s256(TEST_CODE_VERIFIER)},
+			codes.Unauthenticated,
+		},
+		{
+			"missing verifier",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI},
+			codes.Unauthenticated,
+		},
+		{
+			"another registered redirect uri",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "public", RedirectUri: "https://example.com/other", CodeVerifier: TEST_CODE_VERIFIER},
+			codes.Unauthenticated,
+		},
+		{
+			"redirect uri with a trailing slash",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI + "/", CodeVerifier: TEST_CODE_VERIFIER},
+			codes.Unauthenticated,
+		},
+		{
+			"missing redirect uri",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "public", CodeVerifier: TEST_CODE_VERIFIER},
+			codes.Unauthenticated,
+		},
+		{
+			// Codes authorized without a redirect uri must be exchanged without one.
+			"unexpected redirect uri",
+			AuthorizeRequest{ClientId: "other", CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "other", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.Unauthenticated,
+		},
+		{
+			"code of another client",
+			AuthorizeRequest{ClientId: "public", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "other", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.Unauthenticated,
+		},
+		{
+			"confidential client",
+			AuthorizeRequest{ClientId: "confidential", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "confidential", ClientSecret: "secret", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.OK,
+		},
+		{
+			"confidential client without secret",
+			AuthorizeRequest{ClientId: "confidential", RedirectUri: TEST_REDIRECT_URI, CodeChallenge: TEST_CODE_VERIFIER},
+			CreateTokenRequest{ClientId: "confidential", RedirectUri: TEST_REDIRECT_URI, CodeVerifier: TEST_CODE_VERIFIER},
+			codes.Unauthenticated,
+		},
+	}
+	for _, test := range tests {
+		a := newAuthorizationCodeTest(t)
+		test.exchange.Code = a.authorize(t, &test.authorize)
+		authToken, err := a.exchange(&test.exchange)
+		if errorCode(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.name, test.code, err)
+			continue
+		}
+		if err == nil && (authToken.ClientId != test.exchange.ClientId || authToken.UserId != "alice") {
+			t.Errorf("%s: unexpected token for %s of %s", test.name, authToken.UserId, authToken.ClientId)
+		}
+
+		// Codes are single use, so even the correct request fails after the first attempt, whether or not it succeeded.
+		_, err = a.exchange(&CreateTokenRequest{
+			Code:         test.exchange.Code,
+			ClientId:     test.authorize.ClientId,
+			ClientSecret: "secret",
+			RedirectUri:  test.authorize.RedirectUri,
+			CodeVerifier: TEST_CODE_VERIFIER,
+		})
+		if errorCode(err) != codes.Unauthenticated {
+			t.Errorf("%s: expected used code rejected, got %v", test.name, err)
+		}
+	}
+}
+
+func TestAuthorizeRedirectUri(t *testing.T) {
+	a := newAuthorizationCodeTest(t)
+	tests := []struct {
+		clientId    string
+		redirectUri string
+		code        codes.Code
+	}{
+		{"public", TEST_REDIRECT_URI, codes.OK},
+		{"public", "https://example.com/other", codes.OK},
+		{"public", TEST_REDIRECT_URI + "?next=/", codes.InvalidArgument},
+		{"public", "https://example.com/callback/../other", codes.InvalidArgument},
+		{"public", "https://EXAMPLE.com/callback", codes.InvalidArgument},
+		// Clients with several redirect uris must choose one.
+		{"public", "", codes.InvalidArgument},
+		{"other", "", codes.OK},
+	}
+	for _, test := range tests {
+		_, err := a.service.Authorize(a.userCtx, &AuthorizeRequest{
+			ResponseType:  "code",
+			ClientId:      test.clientId,
+			RedirectUri:   test.redirectUri,
+			CodeChallenge: TEST_CODE_VERIFIER,
+		})
+		if errorCode(err) != test.code {
+			t.Errorf("Authorize(%s, %q): expected %v, got %v", test.clientId, test.redirectUri, test.code, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"time"
+)
+
+// ChainUserStore looks up users in each of its stores in turn, until one of them knows the user. A user found in one
+// store is never authenticated against a later one, even if the password does not match. Likewise, any other error,
+// such as ErrAmbiguousUser, stops the chain.
+type ChainUserStore []userStore
+
+func (c ChainUserStore) GetUserInfo(username string) (*UserInfo, error) {
+	for _, store := range c {
+		if userInfo, err := store.GetUserInfo(username); err != ErrUserNotFound {
+			return userInfo, err
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (c ChainUserStore) Authenticate(username string, password string) (*UserInfo, error) {
+	for _, store := range c {
+		if userInfo, err := store.Authenticate(username, password); err != ErrUserNotFound {
+			return userInfo, err
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+// RecordLogin records the login with the first store that knows the user, if it keeps logins at all.
+func (c ChainUserStore) RecordLogin(username string, now time.Time) error {
+	for _, store := range c {
+		if recorder, ok := store.(loginRecorder); ok {
+			if err := recorder.RecordLogin(username, now); err != ErrUserNotFound {
+				return err
+			}
+		} else if _, err := store.GetUserInfo(username); err != ErrUserNotFound {
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
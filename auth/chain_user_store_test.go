@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeUserStore knows the users in its map, with their passwords, and gives them all the same scope. Any other error, if
+// set, is returned for every user.
+type fakeUserStore struct {
+	passwords map[string]string
+	scope     []Scope
+	err       error
+}
+
+func (s *fakeUserStore) GetUserInfo(username string) (*UserInfo, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if _, ok := s.passwords[username]; !ok {
+		return nil, ErrUserNotFound
+	}
+	return &UserInfo{Scope: s.scope}, nil
+}
+
+func (s *fakeUserStore) Authenticate(username string, password string) (*UserInfo, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if p, ok := s.passwords[username]; !ok {
+		return nil, ErrUserNotFound
+	} else if p != password {
+		return nil, ErrIncorrectPassword
+	}
+	return &UserInfo{Scope: s.scope}, nil
+}
+
+type fakeLoginRecorder struct {
+	fakeUserStore
+	logins []string
+}
+
+func (s *fakeLoginRecorder) RecordLogin(username string, now time.Time) error {
+	if _, err := s.GetUserInfo(username); err != nil {
+		return err
+	}
+	s.logins = append(s.logins, username)
+	return nil
+}
+
+func TestChainUserStoreAuthenticate(t *testing.T) {
+	first := &fakeUserStore{passwords: map[string]string{"alice": "first"}}
+	second := &fakeUserStore{passwords: map[string]string{"alice": "second", "bob": "second"}}
+	chain := ChainUserStore{first, second}
+
+	tests := []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"alice", "first", nil},
+		// Users of the first store are never authenticated against the second one.
+		{"alice", "second", ErrIncorrectPassword},
+		{"bob", "second", nil},
+		{"bob", "first", ErrIncorrectPassword},
+		{"carol", "first", ErrUserNotFound},
+	}
+	for _, test := range tests {
+		if _, err := chain.Authenticate(test.username, test.password); err != test.err {
+			t.Errorf("Authenticate(%s, %s): expected %v, got %v", test.username, test.password, test.err, err)
+		}
+	}
+}
+
+func TestChainUserStoreFailsClosed(t *testing.T) {
+	for _, err := range []error{ErrAmbiguousUser, ErrUserDisabled} {
+		chain := ChainUserStore{&fakeUserStore{err: err}, &fakeUserStore{passwords: map[string]string{"alice": "second"}}}
+		if _, e := chain.Authenticate("alice", "second"); e != err {
+			t.Errorf("Authenticate: expected %v, got %v", err, e)
+		}
+		if _, e := chain.GetUserInfo("alice"); e != err {
+			t.Errorf("GetUserInfo: expected %v, got %v", err, e)
+		}
+	}
+}
+
+func TestChainUserStoreGetUserInfo(t *testing.T) {
+	chain := ChainUserStore{
+		&fakeUserStore{passwords: map[string]string{"alice": ""}},
+		&fakeUserStore{passwords: map[string]string{"bob": ""}},
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if _, err := chain.GetUserInfo(username); err != nil {
+			t.Errorf("GetUserInfo(%s): %v", username, err)
+		}
+	}
+	if _, err := chain.GetUserInfo("carol"); err != ErrUserNotFound {
+		t.Errorf("GetUserInfo(carol): expected %v, got %v", ErrUserNotFound, err)
+	}
+}
+
+func TestChainUserStoreRecordLogin(t *testing.T) {
+	directory := &fakeUserStore{passwords: map[string]string{"alice": ""}}
+	database := &fakeLoginRecorder{fakeUserStore: fakeUserStore{passwords: map[string]string{"alice": "", "bob": ""}}}
+	chain := ChainUserStore{directory, database}
+
+	// Logins of users in stores that do not keep them are not recorded with later stores.
+	if err := chain.RecordLogin("alice", time.Now()); err != nil {
+		t.Error(err)
+	}
+	if err := chain.RecordLogin("bob", time.Now()); err != nil {
+		t.Error(err)
+	}
+	if err := chain.RecordLogin("carol", time.Now()); err != ErrUserNotFound {
+		t.Errorf("expected %v, got %v", ErrUserNotFound, err)
+	}
+	if len(database.logins) != 1 || database.logins[0] != "bob" {
+		t.Errorf("unexpected logins %v", database.logins)
+	}
+}
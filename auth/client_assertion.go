@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+const (
+	CLIENT_ASSERTION_TYPE_JWT_BEARER = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// Assertions must expire within this time, which bounds how long their ids need to be remembered.
+	CLIENT_ASSERTION_MAX_LIFETIME = time.Hour
+	CLIENT_ASSERTION_TICKET       = "client_assertion"
+)
+
+// ParsePublicKey parses a PEM encoded RSA public key, as registered for clients that authenticate with JWT assertions.
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("No public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if rsaKey, ok := key.(*rsa.PublicKey); ok {
+		return rsaKey, nil
+	}
+	return nil, errors.New("Public key is not an RSA key")
+}
+
+// audience is the "aud" claim, which is either a single string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*a = values
+	return nil
+}
+
+func (a audience) contains(value string) bool {
+	for _, v := range a {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type clientAssertionClaims struct {
+	Issuer     string   `json:"iss"`
+	Subject    string   `json:"sub"`
+	Audience   audience `json:"aud"`
+	Expiration int64    `json:"exp"`
+	Id         string   `json:"jti"`
+}
+
+// peekJWTClaims decodes the claims of a JWT without verifying it, so that the key to verify it with can be found.
+func peekJWTClaims(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidJWT
+	}
+	if c, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return errInvalidJWT
+	} else if err := json.Unmarshal(c, claims); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
+
+// authenticateClientAssertion implements client authentication with JWTs as in RFC 7523. The client signs the assertion
+// with its private key, and the public key registered for the client verifies it. Each assertion can only be used once.
+func authenticateClientAssertion(store clientStore, clientId string, assertionType string, assertion string, tokenEndpoint string) (string, *ClientInfo, error) {
+	now := time.Now()
+
+	if assertionType != CLIENT_ASSERTION_TYPE_JWT_BEARER {
+		return "", nil, status.Error(codes.InvalidArgument, "Unsupported client assertion type")
+	}
+
+	var claims clientAssertionClaims
+	if err := peekJWTClaims(assertion, &claims); err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Invalid client assertion")
+	}
+	if clientId == "" {
+		clientId = claims.Subject
+	}
+	clientInfo, err := store.GetClientInfo(clientId)
+	if err != nil || clientInfo.PublicKey == "" {
+		return "", nil, status.Error(codes.Unauthenticated, "Invalid client assertion")
+	}
+	publicKey, err := ParsePublicKey(clientInfo.PublicKey)
+	if err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Invalid client assertion")
+	}
+
+	claims = clientAssertionClaims{}
+	if err := parseJWT(assertion, func(*jwtHeader) (*rsa.PublicKey, error) { return publicKey, nil }, &claims); err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Invalid client assertion")
+	}
+	if claims.Issuer != clientId || claims.Subject != clientId {
+		return "", nil, status.Error(codes.Unauthenticated, "Invalid client assertion")
+	}
+	if !claims.Audience.contains(tokenEndpoint) {
+		return "", nil, status.Error(codes.Unauthenticated, "Invalid client assertion audience")
+	}
+	expirationTime := time.Unix(claims.Expiration, 0)
+	if !now.Before(expirationTime) {
+		return "", nil, status.Error(codes.Unauthenticated, "Client assertion expired")
+	}
+	if expirationTime.Sub(now) > CLIENT_ASSERTION_MAX_LIFETIME {
+		return "", nil, status.Error(codes.Unauthenticated, "Client assertion expires too late")
+	}
+	if claims.Id == "" {
+		return "", nil, status.Error(codes.Unauthenticated, "Missing client assertion id")
+	}
+
+	// The id only needs to be remembered until the assertion expires, after which it is rejected as expired anyway.
+	if err := ticketStore.Add(CLIENT_ASSERTION_TICKET, clientId+":"+claims.Id, nil, expirationTime); err == ErrTicketExists {
+		return "", nil, status.Error(codes.Unauthenticated, "Client assertion replayed")
+	} else if err != nil {
+		return "", nil, status.Error(codes.Internal, "Unable to store client assertion")
+	}
+
+	return clientId, clientInfo, nil
+}
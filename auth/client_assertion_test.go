@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+const TEST_TOKEN_ENDPOINT = "https://example.com/oauth/tokens"
+
+// newAssertionClient returns a client that authenticates with assertions signed by the key.
+func newAssertionClient(t *testing.T, key *SigningKey) *ClientInfo {
+	der, err := x509.MarshalPKIXPublicKey(&key.PrivateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ClientInfo{PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}
+}
+
+// validAssertionClaims returns claims that the client may authenticate with, with a new id every time.
+func validAssertionClaims(t *testing.T, clientId string) clientAssertionClaims {
+	id, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientAssertionClaims{
+		Issuer:     clientId,
+		Subject:    clientId,
+		Audience:   audience{TEST_TOKEN_ENDPOINT},
+		Expiration: time.Now().Add(time.Minute).Unix(),
+		Id:         id,
+	}
+}
+
+func signAssertion(t *testing.T, key *SigningKey, claims clientAssertionClaims) string {
+	assertion, err := signJWT(jwtHeader{Kid: key.Id}, &claims, key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestAuthenticateClientAssertion(t *testing.T) {
+	SetTicketStore(NewMemoryTicketStore())
+	key := newTestKey(t)
+	otherKey := newTestKey(t)
+	store := fakeClientStore{
+		"assertion": newAssertionClient(t, key),
+		"other":     newAssertionClient(t, key),
+		"secret":    newConfidentialClient(t, "secret"),
+	}
+
+	tests := []struct {
+		name     string
+		clientId string
+		modify   func(*clientAssertionClaims)
+		key      *SigningKey
+		code     codes.Code
+	}{
+		{"valid", "assertion", func(*clientAssertionClaims) {}, key, codes.OK},
+		{"client id from subject", "", func(*clientAssertionClaims) {}, key, codes.OK},
+		{"one of several audiences", "assertion", func(c *clientAssertionClaims) {
+			c.Audience = audience{"https://example.com", TEST_TOKEN_ENDPOINT}
+		}, key, codes.OK},
+		{"another issuer", "assertion", func(c *clientAssertionClaims) { c.Issuer = "other" }, key, codes.Unauthenticated},
+		{"another subject", "assertion", func(c *clientAssertionClaims) { c.Subject = "other" }, key, codes.Unauthenticated},
+		// Clients sharing a key still cannot authenticate as each other.
+		{"assertion of another client", "other", func(*clientAssertionClaims) {}, key, codes.Unauthenticated},
+		{"another audience", "assertion", func(c *clientAssertionClaims) {
+			c.Audience = audience{"https://example.com"}
+		}, key, codes.Unauthenticated},
+		{"missing audience", "assertion", func(c *clientAssertionClaims) { c.Audience = nil }, key, codes.Unauthenticated},
+		{"expired", "assertion", func(c *clientAssertionClaims) {
+			c.Expiration = time.Now().Add(-time.Second).Unix()
+		}, key, codes.Unauthenticated},
+		{"missing expiration", "assertion", func(c *clientAssertionClaims) { c.Expiration = 0 }, key, codes.Unauthenticated},
+		{"expires too late", "assertion", func(c *clientAssertionClaims) {
+			c.Expiration = time.Now().Add(CLIENT_ASSERTION_MAX_LIFETIME + time.Minute).Unix()
+		}, key, codes.Unauthenticated},
+		{"missing id", "assertion", func(c *clientAssertionClaims) { c.Id = "" }, key, codes.Unauthenticated},
+		{"signed with another key", "assertion", func(*clientAssertionClaims) {}, otherKey, codes.Unauthenticated},
+		{"client without public key", "secret", func(c *clientAssertionClaims) {
+			c.Issuer, c.Subject = "secret", "secret"
+		}, key, codes.Unauthenticated},
+		{"unknown client", "unknown", func(c *clientAssertionClaims) {
+			c.Issuer, c.Subject = "unknown", "unknown"
+		}, key, codes.Unauthenticated},
+	}
+	for _, test := range tests {
+		claims := validAssertionClaims(t, "assertion")
+		test.modify(&claims)
+		assertion := signAssertion(t, test.key, claims)
+		clientId, _, err := authenticateClientAssertion(store, test.clientId, CLIENT_ASSERTION_TYPE_JWT_BEARER, assertion, TEST_TOKEN_ENDPOINT)
+		if errorCode(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.name, test.code, err)
+		} else if err == nil && clientId != "assertion" {
+			t.Errorf("%s: authenticated as %s", test.name, clientId)
+		}
+	}
+
+	assertion := signAssertion(t, key, validAssertionClaims(t, "assertion"))
+	if _, _, err := authenticateClientAssertion(store, "assertion", "urn:example:unknown", assertion, TEST_TOKEN_ENDPOINT); errorCode(err) != codes.InvalidArgument {
+		t.Errorf("unsupported assertion type: expected InvalidArgument, got %v", err)
+	}
+	if _, _, err := authenticateClientAssertion(store, "assertion", CLIENT_ASSERTION_TYPE_JWT_BEARER, "not a jwt", TEST_TOKEN_ENDPOINT); errorCode(err) != codes.Unauthenticated {
+		t.Errorf("malformed assertion: expected Unauthenticated, got %v", err)
+	}
+}
+
+func TestAuthenticateClientAssertionReplay(t *testing.T) {
+	SetTicketStore(NewMemoryTicketStore())
+	key := newTestKey(t)
+	store := fakeClientStore{"assertion": newAssertionClient(t, key), "other": newAssertionClient(t, key)}
+
+	claims := validAssertionClaims(t, "assertion")
+	assertion := signAssertion(t, key, claims)
+	if _, _, err := authenticateClientAssertion(store, "assertion", CLIENT_ASSERTION_TYPE_JWT_BEARER, assertion, TEST_TOKEN_ENDPOINT); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := authenticateClientAssertion(store, "assertion", CLIENT_ASSERTION_TYPE_JWT_BEARER, assertion, TEST_TOKEN_ENDPOINT); errorCode(err) != codes.Unauthenticated {
+		t.Errorf("replayed assertion: expected Unauthenticated, got %v", err)
+	}
+
+	// A new assertion with the same id is a replay too, even though it is signed again.
+	claims.Expiration++
+	if _, _, err := authenticateClientAssertion(store, "assertion", CLIENT_ASSERTION_TYPE_JWT_BEARER, signAssertion(t, key, claims), TEST_TOKEN_ENDPOINT); errorCode(err) != codes.Unauthenticated {
+		t.Errorf("reused id: expected Unauthenticated, got %v", err)
+	}
+
+	// Ids only need to be unique per client.
+	otherClaims := validAssertionClaims(t, "other")
+	otherClaims.Id = claims.Id
+	if _, _, err := authenticateClientAssertion(store, "other", CLIENT_ASSERTION_TYPE_JWT_BEARER, signAssertion(t, key, otherClaims), TEST_TOKEN_ENDPOINT); err != nil {
+		t.Errorf("id of another client: %v", err)
+	}
+}
@@ -2,32 +2,47 @@ package auth
 
 import (
 	"context"
-	"github.com/golang/protobuf/ptypes"
 	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"math"
-	"strings"
 	"time"
 )
 
 type ClientInfo struct {
-	Secret string
-	Scope  []Scope
+	HashedSecret string
+	Scope        []Scope
+	Name         string
+	GrantTypes   []string // Any grant type is allowed if empty
+	RedirectUris []string
+	PublicKey    string // PEM encoded key that verifies the client's JWT assertions, if any
 }
 
-var clients = map[string]ClientInfo{
-	"client": {"password", []Scope{Scope_user_creation, Scope_user_authorize}},
+func (c *ClientInfo) allowsGrantType(grantType string) bool {
+	if len(c.GrantTypes) == 0 {
+		return true
+	}
+	for _, g := range c.GrantTypes {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
 }
 
 type clientStore interface {
 	GetClientInfo(string) (*ClientInfo, error)
 }
 
+type clientRegistry interface {
+	CreateClient(clientId string, secret string, clientInfo *ClientInfo) error
+}
+
 const CLIENT_TOKEN_EXPIRATION = time.Hour * 24
 
 type ClientCredentialsGrantTypeHandler struct {
-	ClientStore clientStore
+	ClientStore   clientStore
+	TokenEndpoint string // The audience that JWT assertions must be issued for
 }
 
 func (h *ClientCredentialsGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, error) {
@@ -39,34 +54,85 @@ func (h *ClientCredentialsGrantTypeHandler) createAuthToken(ctx context.Context,
 		return nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
 	}
 
-	var password string
-	authToken.ClientId, password, err = h.getUsernamePassword(ctx, r)
-	clientInfo, ok := clients[authToken.ClientId]
-	if !ok || password != clientInfo.Secret {
-		return nil, status.Error(codes.Unauthenticated, "Incorrect client id or secret")
-	}
-
-	authToken.Scope = clientInfo.Scope
-
-	authToken.Access, err = generateToken()
-	if err != nil {
-		return nil, err
+	var clientInfo *ClientInfo
+	if r.ClientAssertionType != "" {
+		authToken.ClientId, clientInfo, err = authenticateClientAssertion(h.ClientStore, r.ClientId, r.ClientAssertionType, r.ClientAssertion, h.TokenEndpoint)
+	} else {
+		var clientId, clientSecret string
+		if clientId, clientSecret, err = getClientCredentials(ctx, r.ClientId, r.ClientSecret); err != nil {
+			return nil, err
+		}
+		if clientSecret == "" && peerCertificate(ctx) != nil {
+			authToken.ClientId, clientInfo, err = authenticateClientCertificate(ctx, h.ClientStore, clientId)
+		} else {
+			authToken.ClientId, clientInfo, err = authenticateClient(ctx, h.ClientStore, clientId, clientSecret)
+		}
 	}
-	authToken.AccessCreationTime, err = ptypes.TimestampProto(now)
 	if err != nil {
 		return nil, err
 	}
-	authToken.AccessExpirationTime, err = ptypes.TimestampProto(now.Add(CLIENT_TOKEN_EXPIRATION))
-	if err != nil {
+
+	authToken.Scope = clientInfo.Scope
+
+	if err := issueAccessToken(ctx, &authToken, now, CLIENT_TOKEN_EXPIRATION); err != nil {
 		return nil, err
 	}
 
-	addAuthToken(authToken)
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
 
 	return &authToken, nil
 }
 
-func (h *ClientCredentialsGrantTypeHandler) getUsernamePassword(ctx context.Context, r *CreateTokenRequest) (string, string, error) {
+// requestingClientId returns the id that the client requesting a token claims, without authenticating it, or "" if there
+// is none. Clients of the grant types that authenticate with the token request present their credentials in the request.
+// All others authenticate with their client tokens beforehand.
+func requestingClientId(ctx context.Context, r *CreateTokenRequest) string {
+	switch r.GrantType {
+	case GrantType_client_credentials.String(), GrantType_authorization_code.String(), GRANT_TYPE_DEVICE_CODE:
+		if r.ClientAssertionType != "" {
+			var claims clientAssertionClaims
+			if r.ClientId == "" && peekJWTClaims(r.ClientAssertion, &claims) == nil {
+				return claims.Subject
+			}
+			return r.ClientId
+		}
+		clientId, _, err := getClientCredentials(ctx, r.ClientId, r.ClientSecret)
+		if err != nil {
+			return ""
+		}
+		if cert := peerCertificate(ctx); clientId == "" && cert != nil {
+			return cert.Subject.CommonName
+		}
+		return clientId
+	default:
+		if clientAuthToken, ok := GetAuthToken(ctx); ok && clientAuthToken != nil {
+			return clientAuthToken.ClientId
+		}
+		return ""
+	}
+}
+
+// checkGrantType rejects grant types that the requesting client is not allowed to use. Requests without any client are
+// left to the grant type handlers, which fail to authenticate them.
+func checkGrantType(ctx context.Context, store clientStore, r *CreateTokenRequest) error {
+	clientId := requestingClientId(ctx, r)
+	if clientId == "" {
+		return nil
+	}
+	clientInfo, err := store.GetClientInfo(clientId)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "Unknown client")
+	}
+	if !clientInfo.allowsGrantType(r.GrantType) {
+		return status.Error(codes.PermissionDenied, "Grant type not allowed for client")
+	}
+	return nil
+}
+
+// getClientCredentials returns the client id and secret from basic auth, if present, or otherwise the ones in the request.
+func getClientCredentials(ctx context.Context, clientId string, clientSecret string) (string, string, error) {
 	var username, password string
 	if s, err := grpc_auth.AuthFromMD(ctx, "Basic"); err == nil {
 		if u, p, ok := parseBasicAuth(s); ok {
@@ -76,31 +142,67 @@ func (h *ClientCredentialsGrantTypeHandler) getUsernamePassword(ctx context.Cont
 			return "", "", status.Error(codes.Unauthenticated, "Invalid basic auth")
 		}
 	} else {
-		username = r.ClientId
-		password = r.ClientSecret
+		username = clientId
+		password = clientSecret
 	}
 	return username, password, nil
 }
 
-func (h *ClientCredentialsGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
-	authToken, err := h.createAuthToken(ctx, r)
+func authenticateClient(ctx context.Context, store clientStore, clientId string, clientSecret string) (string, *ClientInfo, error) {
+	clientId, clientSecret, err := getClientCredentials(ctx, clientId, clientSecret)
 	if err != nil {
-		return nil, err
+		return "", nil, err
+	}
+	clientInfo, err := store.GetClientInfo(clientId)
+	if err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Incorrect client id or secret")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(clientInfo.HashedSecret), []byte(clientSecret)); err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Incorrect client id or secret")
 	}
+	return clientId, clientInfo, nil
+}
 
-	resp := CreateTokenResponse{TokenType: "bearer", AccessToken: authToken.Access}
+// identifyClient authenticates the client if it has a secret. Public clients, such as native apps, cannot keep a secret,
+// so all that can be done for them is to check that they exist.
+func identifyClient(ctx context.Context, store clientStore, clientId string, clientSecret string) (string, *ClientInfo, error) {
+	clientId, clientSecret, err := getClientCredentials(ctx, clientId, clientSecret)
+	if err != nil {
+		return "", nil, err
+	}
+	clientInfo, err := store.GetClientInfo(clientId)
+	if err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Unknown client")
+	}
+	if clientInfo.HashedSecret != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(clientInfo.HashedSecret), []byte(clientSecret)); err != nil {
+			return "", nil, status.Error(codes.Unauthenticated, "Incorrect client id or secret")
+		}
+	}
+	return clientId, clientInfo, nil
+}
 
-	var scopeNames []string
-	for _, scope := range authToken.Scope {
-		scopeNames = append(scopeNames, Scope_name[int32(scope)])
+// authenticateAnyClient authenticates clients in any of the ways that the token endpoint accepts: with a JWT assertion,
+// a certificate or a secret. Public clients only need to exist, as with identifyClient.
+func authenticateAnyClient(ctx context.Context, store clientStore, clientId string, clientSecret string, assertionType string, assertion string, tokenEndpoint string) (string, *ClientInfo, error) {
+	if assertionType != "" {
+		return authenticateClientAssertion(store, clientId, assertionType, assertion, tokenEndpoint)
 	}
-	resp.Scope = strings.Join(scopeNames, " ")
+	clientId, clientSecret, err := getClientCredentials(ctx, clientId, clientSecret)
+	if err != nil {
+		return "", nil, err
+	}
+	if clientSecret == "" && peerCertificate(ctx) != nil {
+		return authenticateClientCertificate(ctx, store, clientId)
+	}
+	return identifyClient(ctx, store, clientId, clientSecret)
+}
 
-	t, err := ptypes.Timestamp(authToken.AccessExpirationTime)
+func (h *ClientCredentialsGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, err := h.createAuthToken(ctx, r)
 	if err != nil {
 		return nil, err
 	}
-	resp.ExpiresIn = int32(math.Ceil(t.Sub(time.Now()).Seconds()))
 
-	return &resp, nil
+	return createTokenResponse(authToken)
 }
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+// fakeClientStore knows the clients in its map.
+type fakeClientStore map[string]*ClientInfo
+
+func (s fakeClientStore) GetClientInfo(clientId string) (*ClientInfo, error) {
+	if clientInfo, ok := s[clientId]; ok {
+		return clientInfo, nil
+	}
+	return nil, errors.New("Client not found")
+}
+
+// newConfidentialClient returns a client with the secret, hashed with the lowest cost to keep the tests fast.
+func newConfidentialClient(t *testing.T, secret string, scope ...Scope) *ClientInfo {
+	hashedSecret, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ClientInfo{HashedSecret: string(hashedSecret), Scope: scope}
+}
+
+func TestIdentifyClient(t *testing.T) {
+	store := fakeClientStore{
+		"confidential": newConfidentialClient(t, "secret"),
+		"public":       &ClientInfo{},
+	}
+	tests := []struct {
+		clientId     string
+		clientSecret string
+		valid        bool
+	}{
+		{"confidential", "secret", true},
+		{"confidential", "incorrect", false},
+		{"confidential", "", false},
+		{"public", "", true},
+		// Public clients have no secret to check, so whatever they send is ignored.
+		{"public", "anything", true},
+		{"unknown", "", false},
+	}
+	for _, test := range tests {
+		clientId, _, err := identifyClient(context.Background(), store, test.clientId, test.clientSecret)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("identifyClient(%s, %s): expected error", test.clientId, test.clientSecret)
+			}
+		} else if err != nil {
+			t.Errorf("identifyClient(%s, %s): %v", test.clientId, test.clientSecret, err)
+		} else if clientId != test.clientId {
+			t.Errorf("identifyClient(%s, %s): got client %s", test.clientId, test.clientSecret, clientId)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	GRANT_TYPE_DEVICE_CODE = "urn:ietf:params:oauth:grant-type:device_code"
+
+	DEVICE_CODE_EXPIRATION    = time.Minute * 10
+	DEVICE_CODE_POLL_INTERVAL = time.Second * 5
+	DEVICE_CODE_TICKET        = "device_code"
+	DEVICE_APPROVAL_TICKET    = "device_approval"
+	USER_CODE_TICKET          = "user_code"
+
+	// Vowels are left out so that user codes do not spell words, and similar looking letters are left out as well.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+func generateUserCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b[:userCodeLength/2]) + "-" + string(b[userCodeLength/2:]), nil
+}
+
+// normalizeUserCode accepts user codes typed in lower case, and with or without the dash and spaces.
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, userCode)
+}
+
+func putDeviceAuthorization(deviceCode string, deviceAuthorization *DeviceAuthorization) error {
+	expirationTime, err := ptypes.Timestamp(deviceAuthorization.ExpirationTime)
+	if err != nil {
+		return err
+	}
+	return putTicket(DEVICE_CODE_TICKET, deviceCode, deviceAuthorization, expirationTime)
+}
+
+// DeviceAuthorization implements the device authorization endpoint of RFC 8628 for clients that run on devices without
+// a browser. The device shows the user code and the verification uri to the user, and then polls for a token with the
+// device code until the user has approved or denied it.
+func (c *AuthService) DeviceAuthorization(ctx context.Context, r *DeviceAuthorizationRequest) (*DeviceAuthorizationResponse, error) {
+	now := time.Now()
+
+	// There is no use in device codes while users have nowhere to enter the user codes.
+	if c.DeviceVerificationUri == "" {
+		return nil, status.Error(codes.Unimplemented, "Device authorization not configured")
+	}
+
+	clientId, clientInfo, err := identifyClient(ctx, c.ClientStore, r.ClientId, r.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !clientInfo.allowsGrantType(GRANT_TYPE_DEVICE_CODE) {
+		return nil, status.Error(codes.PermissionDenied, "Grant type not allowed for client")
+	}
+
+	scope, err := ParseScope(r.Scope)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	deviceCode, err := generateToken()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate device code")
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate user code")
+	}
+
+	expirationTime := now.Add(DEVICE_CODE_EXPIRATION)
+	deviceAuthorization := DeviceAuthorization{
+		ClientId: clientId,
+		Scope:    scope,
+		Interval: int32(DEVICE_CODE_POLL_INTERVAL / time.Second),
+	}
+	if deviceAuthorization.ExpirationTime, err = ptypes.TimestampProto(expirationTime); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store device code")
+	}
+	if err := putDeviceAuthorization(deviceCode, &deviceAuthorization); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store device code")
+	}
+	if err := ticketStore.Put(USER_CODE_TICKET, normalizeUserCode(userCode), []byte(deviceCode), expirationTime); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store user code")
+	}
+
+	resp := DeviceAuthorizationResponse{
+		DeviceCode:      deviceCode,
+		UserCode:        userCode,
+		VerificationUri: c.DeviceVerificationUri,
+		ExpiresIn:       int32(DEVICE_CODE_EXPIRATION / time.Second),
+		Interval:        deviceAuthorization.Interval,
+	}
+	if u, err := url.Parse(c.DeviceVerificationUri); err == nil {
+		q := u.Query()
+		q.Set("user_code", userCode)
+		u.RawQuery = q.Encode()
+		resp.VerificationUriComplete = u.String()
+	}
+	return &resp, nil
+}
+
+// ApproveDevice lets the user who entered the user code approve or deny the device with their own token. Each user
+// code can only be used once, but a request that fails, e.g., for lack of scope, does not use it up. The decision is
+// kept apart from the device code, which polls keep updating.
+func (c *AuthService) ApproveDevice(ctx context.Context, r *ApproveDeviceRequest) (*ApproveDeviceResponse, error) {
+	userAuthToken, ok := GetAuthToken(ctx)
+	if !ok || userAuthToken.UserId == "" {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated as a user")
+	}
+
+	userCode := normalizeUserCode(r.UserCode)
+	deviceCode, err := ticketStore.Get(USER_CODE_TICKET, userCode)
+	if err == ErrTicketNotFound {
+		return nil, status.Error(codes.NotFound, "Invalid user code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user code")
+	}
+
+	var deviceAuthorization DeviceAuthorization
+	if err := getTicket(DEVICE_CODE_TICKET, string(deviceCode), &deviceAuthorization); err == ErrTicketNotFound {
+		return nil, status.Error(codes.NotFound, "Invalid user code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch device code")
+	}
+
+	var approval DeviceApproval
+	if r.Deny {
+		approval.Denied = true
+	} else {
+		if approval.Scope, err = grantUserScope(deviceAuthorization.Scope, userAuthToken.Scope); err != nil {
+			return nil, err
+		}
+		approval.UserId = userAuthToken.UserId
+	}
+	expirationTime, err := ptypes.Timestamp(deviceAuthorization.ExpirationTime)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch device code")
+	}
+	value, err := proto.Marshal(&approval)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store approval")
+	}
+
+	// Only the request that manages to take the user code gets to approve or deny the device.
+	if _, err := ticketStore.Take(USER_CODE_TICKET, userCode); err == ErrTicketNotFound {
+		return nil, status.Error(codes.NotFound, "Invalid user code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user code")
+	}
+	if err := ticketStore.Add(DEVICE_APPROVAL_TICKET, string(deviceCode), value, expirationTime); err == ErrTicketExists {
+		return nil, status.Error(codes.NotFound, "Invalid user code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store approval")
+	}
+
+	return &ApproveDeviceResponse{ClientId: deviceAuthorization.ClientId, Scope: scopeString(approval.Scope)}, nil
+}
+
+type DeviceCodeGrantTypeHandler struct {
+	ClientStore clientStore
+	UserStore   userStore
+}
+
+// pending records the poll of a device that the user has not approved or denied yet, and slows the device down if it
+// polls too often. Concurrent polls of the same device may overwrite each other's records, which only affects how much
+// the device is slowed down.
+func (h *DeviceCodeGrantTypeHandler) pending(deviceCode string, deviceAuthorization *DeviceAuthorization, now time.Time) error {
+	var err error
+	interval := time.Duration(deviceAuthorization.Interval) * time.Second
+	lastPollTime, lastPollErr := ptypes.Timestamp(deviceAuthorization.LastPollTime)
+	if deviceAuthorization.LastPollTime, err = ptypes.TimestampProto(now); err != nil {
+		return status.Error(codes.Internal, "Unable to store device code")
+	}
+	// Devices that poll too often have to wait 5 more seconds between polls from then on, as the RFC requires.
+	slowDown := lastPollErr == nil && now.Sub(lastPollTime) < interval
+	if slowDown {
+		deviceAuthorization.Interval += int32(DEVICE_CODE_POLL_INTERVAL / time.Second)
+	}
+	if err := putDeviceAuthorization(deviceCode, deviceAuthorization); err != nil {
+		return status.Error(codes.Internal, "Unable to store device code")
+	}
+	if slowDown {
+		return status.Error(codes.InvalidArgument, "slow_down")
+	}
+	return status.Error(codes.InvalidArgument, "authorization_pending")
+}
+
+// createAuthToken reports the state of the device code with the error codes of RFC 8628 as messages, so that devices can
+// tell them apart. All of them are InvalidArgument, i.e., HTTP 400, as the RFC requires.
+func (h *DeviceCodeGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, error) {
+	var err error
+	var authToken AuthToken
+	now := time.Now()
+
+	if r.GrantType != GRANT_TYPE_DEVICE_CODE {
+		return nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
+	}
+
+	clientId, _, err := identifyClient(ctx, h.ClientStore, r.ClientId, r.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	// Device codes are long and random, so one that cannot be found has almost certainly expired and been purged.
+	var deviceAuthorization DeviceAuthorization
+	if err := getTicket(DEVICE_CODE_TICKET, r.DeviceCode, &deviceAuthorization); err == ErrTicketNotFound {
+		return nil, status.Error(codes.InvalidArgument, "expired_token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch device code")
+	}
+	if deviceAuthorization.ClientId != clientId {
+		return nil, status.Error(codes.Unauthenticated, "Invalid device code")
+	}
+	if isExpired(deviceAuthorization.ExpirationTime, now) {
+		return nil, status.Error(codes.InvalidArgument, "expired_token")
+	}
+
+	var approval DeviceApproval
+	if err := getTicket(DEVICE_APPROVAL_TICKET, r.DeviceCode, &approval); err == ErrTicketNotFound {
+		return nil, h.pending(r.DeviceCode, &deviceAuthorization, now)
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch approval")
+	}
+	if approval.Denied {
+		ticketStore.Delete(DEVICE_CODE_TICKET, r.DeviceCode)
+		return nil, status.Error(codes.InvalidArgument, "access_denied")
+	}
+
+	// Only the poll that manages to take the approval gets the token.
+	if err := takeTicket(DEVICE_APPROVAL_TICKET, r.DeviceCode, &approval); err == ErrTicketNotFound {
+		return nil, status.Error(codes.InvalidArgument, "expired_token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch approval")
+	}
+	if err := ticketStore.Delete(DEVICE_CODE_TICKET, r.DeviceCode); err != nil && err != ErrTicketNotFound {
+		return nil, status.Error(codes.Internal, "Unable to delete device code")
+	}
+
+	// The user may have been removed or had their scope reduced since the device was approved.
+	userInfo, err := h.UserStore.GetUserInfo(approval.UserId)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid device code")
+	}
+	authToken.Scope = narrowUserScope(approval.Scope, userInfo)
+
+	authToken.ClientId = clientId
+	authToken.UserId = approval.UserId
+
+	if err := issueAccessToken(ctx, &authToken, now, USER_TOKEN_EXPIRATION); err != nil {
+		return nil, err
+	}
+
+	authToken.Refresh, err = generateToken()
+	if err != nil {
+		return nil, err
+	}
+	authToken.RefreshExpirationTime, err = ptypes.TimestampProto(now.Add(REFRESH_TOKEN_EXPIRATION))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
+
+	return &authToken, nil
+}
+
+func (h *DeviceCodeGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, err := h.createAuthToken(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenResponse(authToken)
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// interleavingTicketStore runs a hook right after the next read of a ticket of the given kind, as if another request
+// were handled between that read and whatever the reading request does next.
+type interleavingTicketStore struct {
+	TicketStore
+	kind string
+	hook func()
+}
+
+func (s *interleavingTicketStore) Get(kind string, key string) ([]byte, error) {
+	value, err := s.TicketStore.Get(kind, key)
+	if hook := s.hook; kind == s.kind && hook != nil {
+		s.hook = nil
+		hook()
+	}
+	return value, err
+}
+
+type deviceTest struct {
+	service *AuthService
+	handler *DeviceCodeGrantTypeHandler
+	store   *interleavingTicketStore
+	userCtx context.Context
+}
+
+func newDeviceTest() *deviceTest {
+	store := &interleavingTicketStore{TicketStore: NewMemoryTicketStore()}
+	SetTicketStore(store)
+	clients := fakeClientStore{"device": &ClientInfo{}}
+	users := &fakeUserStore{passwords: map[string]string{"alice": ""}, scope: []Scope{Scope_user_profile}}
+	userToken := &AuthToken{ClientId: "browser", UserId: "alice", Scope: []Scope{Scope_user_profile}}
+	return &deviceTest{
+		service: &AuthService{ClientStore: clients, DeviceVerificationUri: "https://example.com/device"},
+		handler: &DeviceCodeGrantTypeHandler{ClientStore: clients, UserStore: users},
+		store:   store,
+		userCtx: context.WithValue(context.Background(), "token", userToken),
+	}
+}
+
+func (d *deviceTest) authorize(t *testing.T) *DeviceAuthorizationResponse {
+	resp, err := d.service.DeviceAuthorization(context.Background(), &DeviceAuthorizationRequest{ClientId: "device", Scope: "user_profile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func (d *deviceTest) poll(deviceCode string) (*AuthToken, error) {
+	return d.handler.createAuthToken(context.Background(), &CreateTokenRequest{
+		GrantType:  GRANT_TYPE_DEVICE_CODE,
+		ClientId:   "device",
+		DeviceCode: deviceCode,
+	})
+}
+
+// errorCode returns the code of a status error, or Unknown for other errors.
+func errorCode(err error) codes.Code {
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	return codes.Unknown
+}
+
+func expectDeviceError(t *testing.T, err error, message string) {
+	if s, ok := status.FromError(err); err == nil || !ok || s.Code() != codes.InvalidArgument || s.Message() != message {
+		t.Errorf("expected %s, got %v", message, err)
+	}
+}
+
+func TestDeviceCodeApproved(t *testing.T) {
+	d := newDeviceTest()
+	resp := d.authorize(t)
+
+	_, err := d.poll(resp.DeviceCode)
+	expectDeviceError(t, err, "authorization_pending")
+	_, err = d.poll(resp.DeviceCode)
+	expectDeviceError(t, err, "slow_down")
+
+	if _, err := d.service.ApproveDevice(d.userCtx, &ApproveDeviceRequest{UserCode: resp.UserCode}); err != nil {
+		t.Fatal(err)
+	}
+	// User codes are used up once the device is approved.
+	if _, err := d.service.ApproveDevice(d.userCtx, &ApproveDeviceRequest{UserCode: resp.UserCode}); errorCode(err) != codes.NotFound {
+		t.Errorf("expected NotFound for used user code, got %v", err)
+	}
+
+	authToken, err := d.poll(resp.DeviceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authToken.ClientId != "device" || authToken.UserId != "alice" {
+		t.Errorf("unexpected token for %s of %s", authToken.UserId, authToken.ClientId)
+	}
+	if len(authToken.Scope) != 1 || authToken.Scope[0] != Scope_user_profile {
+		t.Errorf("unexpected scope %v", authToken.Scope)
+	}
+	// Device codes are used up once the token is issued.
+	_, err = d.poll(resp.DeviceCode)
+	expectDeviceError(t, err, "expired_token")
+}
+
+func TestDeviceCodeDenied(t *testing.T) {
+	d := newDeviceTest()
+	resp := d.authorize(t)
+	if _, err := d.service.ApproveDevice(d.userCtx, &ApproveDeviceRequest{UserCode: resp.UserCode, Deny: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := d.poll(resp.DeviceCode)
+	expectDeviceError(t, err, "access_denied")
+	_, err = d.poll(resp.DeviceCode)
+	expectDeviceError(t, err, "expired_token")
+}
+
+func TestDeviceCodeApprovedDuringPoll(t *testing.T) {
+	d := newDeviceTest()
+	resp := d.authorize(t)
+
+	// The approval is handled after the poll has read the pending device code, but before the poll records itself.
+	approved := false
+	d.store.kind = DEVICE_CODE_TICKET
+	d.store.hook = func() {
+		d.store.kind = ""
+		if _, err := d.service.ApproveDevice(d.userCtx, &ApproveDeviceRequest{UserCode: resp.UserCode}); err != nil {
+			t.Error(err)
+		}
+		approved = true
+	}
+	authToken, err := d.poll(resp.DeviceCode)
+	if !approved {
+		t.Fatal("approval not interleaved")
+	}
+	if err != nil {
+		expectDeviceError(t, err, "authorization_pending")
+		// Polls that started before the approval may report it as pending, but must not lose it.
+		if authToken, err = d.poll(resp.DeviceCode); err != nil {
+			t.Fatalf("approval lost: %v", err)
+		}
+	}
+	if authToken.UserId != "alice" {
+		t.Errorf("unexpected token for %s", authToken.UserId)
+	}
+}
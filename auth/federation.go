@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GRANT_TYPE_JWT_BEARER = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+	// FEDERATED_ID_TOKEN_TICKET remembers the upstream ID tokens that have been exchanged, so that they cannot be replayed.
+	FEDERATED_ID_TOKEN_TICKET = "federated_id_token"
+
+	// UPSTREAM_KEY_RELOAD_INTERVAL limits how often the upstream JWKS is reloaded because of an unknown key id.
+	UPSTREAM_KEY_RELOAD_INTERVAL = time.Minute
+)
+
+var (
+	ErrFederationDisabled = errors.New("Federated login is not configured")
+
+	federation *FederatedProvider
+
+	upstreamClient = &http.Client{Timeout: time.Second * 10}
+)
+
+// FederatedProvider is an upstream OpenID provider whose ID tokens are accepted in place of passwords. Its JWKS is
+// loaded from JwksLocation, which is either an http(s) URL or the path of a local file.
+type FederatedProvider struct {
+	Issuer       string
+	Audience     string // The client id of this server at the provider
+	JwksLocation string
+
+	mutex      sync.Mutex
+	keys       map[string]*rsa.PublicKey
+	reloadTime time.Time
+}
+
+// FederatedIdentity is the identity that an upstream ID token asserts.
+type FederatedIdentity struct {
+	Issuer            string
+	Subject           string
+	PreferredUsername string
+}
+
+func SetFederatedProvider(provider *FederatedProvider) {
+	federation = provider
+}
+
+func parseJwk(jwk *Jwk) (*rsa.PublicKey, error) {
+	if jwk.Kty != "RSA" {
+		return nil, errors.New("Unsupported key type " + jwk.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (p *FederatedProvider) readJwks() ([]byte, error) {
+	if strings.HasPrefix(p.JwksLocation, "http://") || strings.HasPrefix(p.JwksLocation, "https://") {
+		resp, err := upstreamClient.Get(p.JwksLocation)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("Unable to fetch JWKS: " + resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+	return ioutil.ReadFile(p.JwksLocation)
+}
+
+func (p *FederatedProvider) loadKeys() error {
+	data, err := p.readJwks()
+	if err != nil {
+		return err
+	}
+	var jwks Jwks
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := parseJwk(jwk); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	p.keys = keys
+	return nil
+}
+
+// keyFunc returns the upstream key with the id in the header. The JWKS is reloaded for unknown key ids, which picks up
+// key rotations by the provider, but no more often than UPSTREAM_KEY_RELOAD_INTERVAL.
+func (p *FederatedProvider) keyFunc(header *jwtHeader) (*rsa.PublicKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if key, ok := p.keys[header.Kid]; ok {
+		return key, nil
+	}
+	now := time.Now()
+	if now.Sub(p.reloadTime) < UPSTREAM_KEY_RELOAD_INTERVAL {
+		return nil, ErrKeyNotFound
+	}
+	p.reloadTime = now
+	if err := p.loadKeys(); err != nil {
+		return nil, err
+	}
+	if key, ok := p.keys[header.Kid]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+type upstreamIdTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	Expiration        int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Id                string   `json:"jti"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// ticketKey identifies the ID token by its jti, or by the time at which it was issued to the subject if the provider does
+// not set one.
+func (c *upstreamIdTokenClaims) ticketKey() string {
+	if c.Id != "" {
+		return c.Issuer + ":" + c.Subject + ":jti:" + c.Id
+	}
+	if c.IssuedAt != 0 {
+		return c.Issuer + ":" + c.Subject + ":iat:" + strconv.FormatInt(c.IssuedAt, 10)
+	}
+	return ""
+}
+
+func verifyFederatedIdToken(token string) (*upstreamIdTokenClaims, error) {
+	p := federation
+	if p == nil {
+		return nil, ErrFederationDisabled
+	}
+	var claims upstreamIdTokenClaims
+	if err := parseJWT(token, p.keyFunc, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != p.Issuer || claims.Subject == "" || !claims.Audience.contains(p.Audience) {
+		return nil, errInvalidJWT
+	}
+	if !time.Now().Before(time.Unix(claims.Expiration, 0)) {
+		return nil, errors.New("ID token expired")
+	}
+	return &claims, nil
+}
+
+// VerifyFederatedIdToken verifies an ID token of the upstream provider and returns the identity that it asserts.
+func VerifyFederatedIdToken(token string) (*FederatedIdentity, error) {
+	claims, err := verifyFederatedIdToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return &FederatedIdentity{Issuer: claims.Issuer, Subject: claims.Subject, PreferredUsername: claims.PreferredUsername}, nil
+}
+
+type federatedUserStore interface {
+	GetUserInfo(string) (*UserInfo, error)
+	// ProvisionFederatedUser returns the user linked to the identity, creating the user and the link if there is none.
+	ProvisionFederatedUser(identity *FederatedIdentity) (string, error)
+}
+
+// JwtBearerGrantTypeHandler implements the authorization grant of RFC 7523, where the assertion is an ID token of the
+// upstream provider. Like with the password grant, the client authenticates with its own token, which needs the
+// user_authorize scope, and users with a second factor have to enter it as well. Each ID token can only be exchanged
+// once.
+type JwtBearerGrantTypeHandler struct {
+	UserStore federatedUserStore
+}
+
+func (h *JwtBearerGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, error) {
+	var err error
+	var authToken AuthToken
+	now := time.Now()
+
+	if r.GrantType != GRANT_TYPE_JWT_BEARER {
+		return nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
+	}
+
+	clientAuthToken, ok := GetAuthToken(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated")
+	}
+	if !HasScope(Scope_user_authorize, clientAuthToken) {
+		return nil, status.Error(codes.Unauthenticated, "Insufficient scope")
+	}
+	authToken.ClientId = clientAuthToken.ClientId
+
+	claims, err := verifyFederatedIdToken(r.Assertion)
+	if err == ErrFederationDisabled {
+		return nil, status.Error(codes.Unimplemented, "Federated login is not configured")
+	} else if err != nil || claims.ticketKey() == "" {
+		return nil, status.Error(codes.Unauthenticated, "Invalid assertion")
+	}
+	// The ID token only needs to be remembered until it expires, after which it is rejected as expired anyway.
+	if err := ticketStore.Add(FEDERATED_ID_TOKEN_TICKET, claims.ticketKey(), nil, time.Unix(claims.Expiration, 0)); err == ErrTicketExists {
+		return nil, status.Error(codes.Unauthenticated, "Assertion replayed")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store assertion")
+	}
+	identity := &FederatedIdentity{Issuer: claims.Issuer, Subject: claims.Subject, PreferredUsername: claims.PreferredUsername}
+
+	if authToken.UserId, err = h.UserStore.ProvisionFederatedUser(identity); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to provision user")
+	}
+	userInfo, err := h.UserStore.GetUserInfo(authToken.UserId)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid assertion")
+	}
+
+	scope, err := ParseScope(r.Scope)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if authToken.Scope, err = grantUserScope(scope, userInfo.Scope); err != nil {
+		return nil, err
+	}
+
+	// The upstream provider only replaces the password, not the second factor of the user here.
+	if userInfo.MfaEnabled {
+		return nil, mfaRequired(&authToken)
+	}
+
+	if err := issueAccessToken(ctx, &authToken, now, USER_TOKEN_EXPIRATION); err != nil {
+		return nil, err
+	}
+
+	authToken.Refresh, err = generateToken()
+	if err != nil {
+		return nil, err
+	}
+	authToken.RefreshExpirationTime, err = ptypes.TimestampProto(now.Add(REFRESH_TOKEN_EXPIRATION))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
+
+	return &authToken, nil
+}
+
+func (h *JwtBearerGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, err := h.createAuthToken(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenResponse(authToken)
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "postgres-grpc-example"
+)
+
+// standInIssuer serves the JWKS of an upstream provider, and signs ID tokens like the provider would.
+type standInIssuer struct {
+	*httptest.Server
+	key *SigningKey
+}
+
+func newStandInIssuer(t *testing.T) *standInIssuer {
+	key, err := NewSigningKey(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &standInIssuer{key: key}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&Jwks{Keys: []*Jwk{newJwk(issuer.key)}})
+	}))
+	return issuer
+}
+
+func (issuer *standInIssuer) provider() *FederatedProvider {
+	return &FederatedProvider{Issuer: testIssuer, Audience: testAudience, JwksLocation: issuer.URL}
+}
+
+func (issuer *standInIssuer) sign(t *testing.T, key *SigningKey, claims *upstreamIdTokenClaims) string {
+	token, err := signJWT(jwtHeader{Kid: key.Id}, claims, key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// validIdTokenClaims returns claims with a new jti every time.
+func validIdTokenClaims(t *testing.T) *upstreamIdTokenClaims {
+	jti, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &upstreamIdTokenClaims{
+		Issuer:            testIssuer,
+		Subject:           "1234",
+		Audience:          audience{testAudience},
+		Expiration:        time.Now().Add(time.Minute).Unix(),
+		IssuedAt:          time.Now().Unix(),
+		Id:                jti,
+		PreferredUsername: "alice",
+	}
+}
+
+func TestVerifyFederatedIdToken(t *testing.T) {
+	issuer := newStandInIssuer(t)
+	defer issuer.Close()
+	otherKey, err := NewSigningKey(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another key with the id of the issuer's key, as if the signature were forged.
+	forgedKey := &SigningKey{Id: issuer.key.Id, PrivateKey: otherKey.PrivateKey}
+
+	tests := []struct {
+		name   string
+		key    *SigningKey
+		modify func(*upstreamIdTokenClaims)
+		valid  bool
+	}{
+		{"valid", issuer.key, func(*upstreamIdTokenClaims) {}, true},
+		{"one of several audiences", issuer.key, func(c *upstreamIdTokenClaims) { c.Audience = audience{"other", testAudience} }, true},
+		{"other issuer", issuer.key, func(c *upstreamIdTokenClaims) { c.Issuer = "https://other.example.com" }, false},
+		{"other audience", issuer.key, func(c *upstreamIdTokenClaims) { c.Audience = audience{"other"} }, false},
+		{"no subject", issuer.key, func(c *upstreamIdTokenClaims) { c.Subject = "" }, false},
+		{"expired", issuer.key, func(c *upstreamIdTokenClaims) { c.Expiration = time.Now().Unix() - 1 }, false},
+		{"unknown key", otherKey, func(*upstreamIdTokenClaims) {}, false},
+		{"forged signature", forgedKey, func(*upstreamIdTokenClaims) {}, false},
+	}
+	for _, test := range tests {
+		SetFederatedProvider(issuer.provider())
+		claims := validIdTokenClaims(t)
+		test.modify(claims)
+		identity, err := VerifyFederatedIdToken(issuer.sign(t, test.key, claims))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if *identity != (FederatedIdentity{testIssuer, "1234", "alice"}) {
+			t.Errorf("%s: unexpected identity %+v", test.name, identity)
+		}
+	}
+	SetFederatedProvider(nil)
+}
+
+func TestVerifyFederatedIdTokenDisabled(t *testing.T) {
+	SetFederatedProvider(nil)
+	if _, err := VerifyFederatedIdToken("a.b.c"); err != ErrFederationDisabled {
+		t.Errorf("expected ErrFederationDisabled, got %v", err)
+	}
+}
+
+type fakeFederatedUserStore struct {
+	users      map[FederatedIdentity]string
+	userScopes map[string][]Scope
+	mfaEnabled bool
+}
+
+func (s *fakeFederatedUserStore) GetUserInfo(userId string) (*UserInfo, error) {
+	scope, ok := s.userScopes[userId]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &UserInfo{Scope: scope, MfaEnabled: s.mfaEnabled}, nil
+}
+
+func (s *fakeFederatedUserStore) ProvisionFederatedUser(identity *FederatedIdentity) (string, error) {
+	if userId, ok := s.users[*identity]; ok {
+		return userId, nil
+	}
+	userId := identity.PreferredUsername
+	s.users[*identity] = userId
+	s.userScopes[userId] = []Scope{Scope_user_profile}
+	return userId, nil
+}
+
+func newJwtBearerTest(t *testing.T) (*standInIssuer, *JwtBearerGrantTypeHandler, *fakeFederatedUserStore, context.Context) {
+	SetTicketStore(NewMemoryTicketStore())
+	issuer := newStandInIssuer(t)
+	SetFederatedProvider(issuer.provider())
+	store := &fakeFederatedUserStore{users: map[FederatedIdentity]string{}, userScopes: map[string][]Scope{}}
+	clientAuthToken := &AuthToken{ClientId: "client", Scope: []Scope{Scope_user_authorize}}
+	return issuer, &JwtBearerGrantTypeHandler{UserStore: store}, store, context.WithValue(context.Background(), "token", clientAuthToken)
+}
+
+func TestJwtBearerGrant(t *testing.T) {
+	issuer, h, store, ctx := newJwtBearerTest(t)
+	defer issuer.Close()
+	defer SetFederatedProvider(nil)
+
+	// Logging in twice with the same identity provisions the user only once.
+	for i := 0; i < 2; i++ {
+		assertion := issuer.sign(t, issuer.key, validIdTokenClaims(t))
+		authToken, err := h.createAuthToken(ctx, &CreateTokenRequest{GrantType: GRANT_TYPE_JWT_BEARER, Assertion: assertion})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authToken.ClientId != "client" || authToken.UserId != "alice" {
+			t.Errorf("unexpected token for %s of %s", authToken.UserId, authToken.ClientId)
+		}
+		if len(authToken.Scope) != 1 || authToken.Scope[0] != Scope_user_profile {
+			t.Errorf("unexpected scope %v", authToken.Scope)
+		}
+	}
+	if len(store.users) != 1 {
+		t.Errorf("expected 1 provisioned user, got %d", len(store.users))
+	}
+
+	assertion := issuer.sign(t, issuer.key, validIdTokenClaims(t))
+	if _, err := h.createAuthToken(ctx, &CreateTokenRequest{GrantType: GRANT_TYPE_JWT_BEARER, Assertion: assertion + "x"}); err == nil {
+		t.Error("expected error for invalid assertion")
+	}
+	noScopeCtx := context.WithValue(context.Background(), "token", &AuthToken{ClientId: "client"})
+	if _, err := h.createAuthToken(noScopeCtx, &CreateTokenRequest{GrantType: GRANT_TYPE_JWT_BEARER, Assertion: assertion}); err == nil {
+		t.Error("expected error for client without user_authorize scope")
+	}
+}
+
+func TestJwtBearerGrantReplay(t *testing.T) {
+	issuer, h, _, ctx := newJwtBearerTest(t)
+	defer issuer.Close()
+	defer SetFederatedProvider(nil)
+
+	withoutJti := validIdTokenClaims(t)
+	withoutJti.Id = ""
+	withoutIds := validIdTokenClaims(t)
+	withoutIds.Id = ""
+	withoutIds.IssuedAt = 0
+	tests := []struct {
+		name   string
+		claims *upstreamIdTokenClaims
+		valid  bool
+	}{
+		{"jti", validIdTokenClaims(t), true},
+		{"iat", withoutJti, true},
+		{"neither jti nor iat", withoutIds, false},
+	}
+	for _, test := range tests {
+		assertion := issuer.sign(t, issuer.key, test.claims)
+		_, err := h.createAuthToken(ctx, &CreateTokenRequest{GrantType: GRANT_TYPE_JWT_BEARER, Assertion: assertion})
+		if !test.valid {
+			if errorCode(err) != codes.Unauthenticated {
+				t.Errorf("%s: expected Unauthenticated, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if _, err := h.createAuthToken(ctx, &CreateTokenRequest{GrantType: GRANT_TYPE_JWT_BEARER, Assertion: assertion}); errorCode(err) != codes.Unauthenticated {
+			t.Errorf("%s: expected Unauthenticated for replayed assertion, got %v", test.name, err)
+		}
+	}
+}
+
+func TestJwtBearerGrantMfa(t *testing.T) {
+	issuer, h, store, ctx := newJwtBearerTest(t)
+	defer issuer.Close()
+	defer SetFederatedProvider(nil)
+	store.mfaEnabled = true
+
+	assertion := issuer.sign(t, issuer.key, validIdTokenClaims(t))
+	_, err := h.createAuthToken(ctx, &CreateTokenRequest{GrantType: GRANT_TYPE_JWT_BEARER, Assertion: assertion})
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.Unauthenticated || s.Message() != "mfa_required" {
+		t.Fatalf("expected mfa_required, got %v", err)
+	}
+	var mfaToken string
+	for _, detail := range s.Details() {
+		if d, ok := detail.(*MfaRequired); ok {
+			mfaToken = d.MfaToken
+		}
+	}
+	var ticket MfaTicket
+	if err := getTicket(MFA_TOKEN_TICKET, mfaToken, &ticket); err != nil {
+		t.Fatal(err)
+	}
+	if ticket.ClientId != "client" || ticket.UserId != "alice" {
+		t.Errorf("unexpected mfa ticket for %s of %s", ticket.UserId, ticket.ClientId)
+	}
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// MarshalJSON always includes "active", which RFC 7662 requires even when it is false.
+func (r *IntrospectTokenResponse) MarshalJSON() ([]byte, error) {
+	type response IntrospectTokenResponse
+	return json.Marshal(struct {
+		Active bool `json:"active"`
+		*response
+	}{r.Active, (*response)(r)})
+}
+
+// IntrospectToken implements RFC 7662. Tokens that are unknown, revoked or expired are reported as inactive.
+func (c *AuthService) IntrospectToken(ctx context.Context, r *IntrospectTokenRequest) (*IntrospectTokenResponse, error) {
+	authToken, err := findAuthToken(r.Token, r.TokenTypeHint)
+	if err == ErrTokenNotFound && jwtAccessTokens && isJWT(r.Token) {
+		// Purged tokens are expired anyway, but this also keeps introspection working for JWTs issued elsewhere. Revoked
+		// tokens are denied even after their rows have been removed, though.
+		if authToken, err = parseAccessToken(r.Token); err != nil {
+			err = ErrTokenNotFound
+		} else {
+			err = checkAccessTokenDenied(r.Token)
+		}
+	}
+	if err == ErrTokenNotFound {
+		return &IntrospectTokenResponse{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch token")
+	}
+
+	now := time.Now()
+	resp := IntrospectTokenResponse{
+		Scope:    scopeString(authToken.Scope),
+		ClientId: authToken.ClientId,
+		Username: authToken.UserId,
+	}
+	expiration := authToken.AccessExpirationTime
+	if authToken.Refresh != "" && authToken.Refresh == r.Token {
+		resp.TokenType = "refresh_token"
+		expiration = authToken.RefreshExpirationTime
+	} else {
+		resp.TokenType = "bearer"
+	}
+	if isExpired(expiration, now) {
+		return &IntrospectTokenResponse{}, nil
+	}
+	resp.Active = true
+
+	if t, err := ptypes.Timestamp(expiration); err == nil {
+		resp.Exp = t.Unix()
+	}
+	if t, err := ptypes.Timestamp(authToken.AccessCreationTime); err == nil {
+		resp.Iat = t.Unix()
+	}
+	return &resp, nil
+}
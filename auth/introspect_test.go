@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// useJWTAccessTokens issues JWT access tokens signed with a new key, and returns a function that switches back to
+// opaque tokens.
+func useJWTAccessTokens(t *testing.T) func() {
+	store := &MemoryKeyStore{}
+	if err := store.Add(newTestKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	SetKeyStore(store)
+	jwtAccessTokens = true
+	return func() {
+		jwtAccessTokens = false
+		SetKeyStore(nil)
+	}
+}
+
+func introspect(t *testing.T, token string) *IntrospectTokenResponse {
+	resp, err := (&AuthService{}).IntrospectToken(context.Background(), &IntrospectTokenRequest{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestIntrospectToken(t *testing.T) {
+	SetTokenStore(NewMemoryTokenStore())
+	SetTicketStore(NewMemoryTicketStore())
+	authToken := &AuthToken{ClientId: "public", UserId: "alice"}
+	if err := issueAccessToken(context.Background(), authToken, time.Now(), USER_TOKEN_EXPIRATION); err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authToken.Refresh, authToken.RefreshExpirationTime = refresh, authToken.AccessExpirationTime
+	if err := addAuthToken(*authToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := introspect(t, authToken.Access); !resp.Active || resp.TokenType != "bearer" || resp.ClientId != "public" || resp.Username != "alice" {
+		t.Errorf("unexpected response for access token %+v", resp)
+	}
+	if resp := introspect(t, authToken.Refresh); !resp.Active || resp.TokenType != "refresh_token" {
+		t.Errorf("unexpected response for refresh token %+v", resp)
+	}
+	if resp := introspect(t, "unknown"); resp.Active {
+		t.Errorf("expected unknown token inactive, got %+v", resp)
+	}
+
+	if err := removeAuthToken(*authToken); err != nil {
+		t.Fatal(err)
+	}
+	if resp := introspect(t, authToken.Access); resp.Active {
+		t.Errorf("expected revoked access token inactive, got %+v", resp)
+	}
+	if resp := introspect(t, authToken.Refresh); resp.Active {
+		t.Errorf("expected revoked refresh token inactive, got %+v", resp)
+	}
+}
+
+func TestIntrospectDeniedJWT(t *testing.T) {
+	defer useJWTAccessTokens(t)()
+	SetTokenStore(NewMemoryTokenStore())
+	SetTicketStore(NewMemoryTicketStore())
+
+	authToken := AuthToken{ClientId: "public", UserId: "alice", Scope: []Scope{Scope_user_profile}}
+	if err := issueAccessToken(context.Background(), &authToken, time.Now(), USER_TOKEN_EXPIRATION); err != nil {
+		t.Fatal(err)
+	}
+	if !isJWT(authToken.Access) {
+		t.Fatalf("expected JWT access token, got %s", authToken.Access)
+	}
+
+	// JWTs are verified without the token store, so they are active even if they are not stored.
+	if resp := introspect(t, authToken.Access); !resp.Active || resp.ClientId != "public" || resp.Username != "alice" || resp.Scope != "user_profile" {
+		t.Errorf("unexpected response for unstored JWT %+v", resp)
+	}
+
+	if err := addAuthToken(authToken); err != nil {
+		t.Fatal(err)
+	}
+	if resp := introspect(t, authToken.Access); !resp.Active {
+		t.Errorf("expected stored JWT active, got %+v", resp)
+	}
+
+	// Once revoked, the JWT is no longer in the token store, but still verifies. The denial must keep it inactive.
+	if err := removeAuthToken(authToken); err != nil {
+		t.Fatal(err)
+	}
+	if resp := introspect(t, authToken.Access); resp.Active {
+		t.Errorf("expected denied JWT inactive, got %+v", resp)
+	}
+}
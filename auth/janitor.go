@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"github.com/tfeng/postgres-grpc-example/config"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Janitor periodically runs a maintenance task, such as evicting tokens that can no longer be used from the token store.
+type Janitor struct {
+	interval time.Duration
+	task     func()
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func startJanitor(interval time.Duration, task func()) *Janitor {
+	j := &Janitor{interval: interval, task: task, stop: make(chan struct{}), done: make(chan struct{})}
+	go j.run()
+	return j
+}
+
+func StartJanitor(interval time.Duration) *Janitor {
+	return startJanitor(interval, func() {
+		purgeExpiredTokens()
+		purgeExpiredTickets()
+	})
+}
+
+// StartKeyRotation rotates signing keys once they are older than the interval. Rotation is checked for more often than
+// that, so that replicas starting at different times share keys instead of each creating their own.
+func StartKeyRotation(interval time.Duration) *Janitor {
+	checkInterval := interval
+	if checkInterval > time.Hour {
+		checkInterval = time.Hour
+	}
+	return startJanitor(checkInterval, func() {
+		if err := RotateKeys(interval); err != nil {
+			config.Logger.Error("Unable to rotate keys", zap.Error(err))
+		}
+	})
+}
+
+func (j *Janitor) run() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			j.task()
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+func purgeExpiredTokens() {
+	if count, err := tokenStore.PurgeExpired(time.Now()); err != nil {
+		config.Logger.Error("Unable to purge expired tokens", zap.Error(err))
+	} else if count > 0 {
+		config.Logger.Info("Purged expired tokens", zap.Int("count", count))
+	}
+}
+
+func purgeExpiredTickets() {
+	if count, err := ticketStore.PurgeExpired(time.Now()); err != nil {
+		config.Logger.Error("Unable to purge expired tickets", zap.Error(err))
+	} else if count > 0 {
+		config.Logger.Info("Purged expired tickets", zap.Int("count", count))
+	}
+}
+
+// Stop stops the janitor and waits for a task in progress, if any, to finish. It is safe to call more than once.
+func (j *Janitor) Stop() {
+	j.once.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var errInvalidJWT = errors.New("Invalid JWT")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// jwtKeyFunc returns the public key to verify a JWT with, given its header.
+type jwtKeyFunc func(*jwtHeader) (*rsa.PublicKey, error)
+
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func signJWT(header jwtHeader, claims interface{}, key *rsa.PrivateKey) (string, error) {
+	header.Alg = "RS256"
+	header.Typ = "JWT"
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseJWT verifies the signature of an RS256 JWT and decodes its claims. The claims themselves, such as the expiration
+// time, are not checked.
+func parseJWT(token string, keyFunc jwtKeyFunc, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidJWT
+	}
+
+	var header jwtHeader
+	if h, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return errInvalidJWT
+	} else if err := json.Unmarshal(h, &header); err != nil {
+		return errInvalidJWT
+	}
+	if header.Alg != "RS256" {
+		return errInvalidJWT
+	}
+
+	key, err := keyFunc(&header)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errInvalidJWT
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return errInvalidJWT
+	}
+
+	if c, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return errInvalidJWT
+	} else if err := json.Unmarshal(c, claims); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
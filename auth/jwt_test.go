@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Subject string `json:"sub"`
+}
+
+func newTestKey(t *testing.T) *SigningKey {
+	key, err := NewSigningKey(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func publicKeyFunc(key *SigningKey) jwtKeyFunc {
+	return func(header *jwtHeader) (*rsa.PublicKey, error) {
+		if header.Kid != key.Id {
+			return nil, errInvalidJWT
+		}
+		return &key.PrivateKey.PublicKey, nil
+	}
+}
+
+func TestSignAndParseJWT(t *testing.T) {
+	key := newTestKey(t)
+	token, err := signJWT(jwtHeader{Kid: key.Id}, &testClaims{"alice"}, key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isJWT(token) {
+		t.Errorf("%s is not recognized as a JWT", token)
+	}
+	var claims testClaims
+	if err := parseJWT(token, publicKeyFunc(key), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "alice" {
+		t.Errorf("expected subject alice, got %s", claims.Subject)
+	}
+}
+
+func TestParseInvalidJWT(t *testing.T) {
+	key := newTestKey(t)
+	otherKey := newTestKey(t)
+	token, err := signJWT(jwtHeader{Kid: key.Id}, &testClaims{"alice"}, key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	// Signed with another key, but claiming the id of the expected one.
+	forged, err := signJWT(jwtHeader{Kid: key.Id}, &testClaims{"alice"}, otherKey.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	signature[0] ^= 1
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered claims", parts[0] + "." + encode(`{"sub":"bob"}`) + "." + parts[2]},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature)},
+		{"forged signature", forged},
+		{"no signature", parts[0] + "." + parts[1] + "."},
+		{"alg none", encode(`{"alg":"none","kid":"`+key.Id+`"}`) + "." + parts[1] + "."},
+		{"alg HS256", encode(`{"alg":"HS256","kid":"`+key.Id+`"}`) + "." + parts[1] + "." + parts[2]},
+		{"malformed header", "x" + token},
+		{"malformed signature", token + "!"},
+		{"malformed claims", parts[0] + "." + encode("alice") + "." + parts[2]},
+		{"two parts", parts[0] + "." + parts[1]},
+		{"four parts", token + ".x"},
+		{"empty", ""},
+	}
+	for _, test := range tests {
+		if err := parseJWT(test.token, publicKeyFunc(key), &testClaims{}); err != errInvalidJWT {
+			t.Errorf("%s: expected %v, got %v", test.name, errInvalidJWT, err)
+		}
+	}
+}
+
+func TestParseJWTKeyFuncError(t *testing.T) {
+	key := newTestKey(t)
+	token, err := signJWT(jwtHeader{Kid: key.Id}, &testClaims{"alice"}, key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errUnknownKey := errors.New("Unknown key")
+	keyFunc := func(*jwtHeader) (*rsa.PublicKey, error) {
+		return nil, errUnknownKey
+	}
+	if err := parseJWT(token, keyFunc, &testClaims{}); err != errUnknownKey {
+		t.Errorf("expected %v, got %v", errUnknownKey, err)
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	tests := []struct {
+		token string
+		jwt   bool
+	}{
+		{"a.b.c", true},
+		{"..", true},
+		{"0123456789abcdef", false},
+		{"a.b", false},
+		{"a.b.c.d", false},
+	}
+	for _, test := range tests {
+		if isJWT(test.token) != test.jwt {
+			t.Errorf("isJWT(%q): expected %v", test.token, test.jwt)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pemType            = "RSA PRIVATE KEY"
+	pemIdHeader        = "Key-Id"
+	pemCreationHeader  = "Creation-Time"
+	pemFileNameExt     = ".pem"
+	pemFilePermissions = 0600
+)
+
+// EncodeSigningKey encodes the key as PEM, with its id and creation time as headers.
+func EncodeSigningKey(key *SigningKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: pemType,
+		Headers: map[string]string{
+			pemIdHeader:       key.Id,
+			pemCreationHeader: key.CreationTime.UTC().Format(time.RFC3339),
+		},
+		Bytes: x509.MarshalPKCS1PrivateKey(key.PrivateKey),
+	})
+}
+
+// DecodeSigningKey decodes a PEM-encoded RSA private key. Keys without headers, e.g., generated with openssl, are given
+// their thumbprint as id and the fallback as creation time.
+func DecodeSigningKey(data []byte, fallbackCreationTime time.Time) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, errors.New("Not a PEM-encoded RSA private key")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := SigningKey{Id: block.Headers[pemIdHeader], PrivateKey: privateKey, CreationTime: fallbackCreationTime}
+	if key.Id == "" {
+		key.Id = keyId(&privateKey.PublicKey)
+	}
+	if s, ok := block.Headers[pemCreationHeader]; ok {
+		if key.CreationTime, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// FileKeyStore keeps one PEM file per key in a directory, which can be a volume shared by all replicas.
+type FileKeyStore struct {
+	Dir string
+}
+
+func (s *FileKeyStore) List() ([]*SigningKey, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []*SigningKey
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), pemFileNameExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := DecodeSigningKey(data, file.ModTime())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *FileKeyStore) Add(key *SigningKey) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.Dir, key.Id+pemFileNameExt), EncodeSigningKey(key), pemFilePermissions)
+}
+
+func (s *FileKeyStore) Remove(id string) error {
+	// Keys that were provisioned by hand may have any file name.
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), pemFileNameExt) {
+			continue
+		}
+		path := filepath.Join(s.Dir, file.Name())
+		if data, err := ioutil.ReadFile(path); err != nil {
+			return err
+		} else if key, err := DecodeSigningKey(data, file.ModTime()); err == nil && key.Id == id {
+			return os.Remove(path)
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// MemoryKeyStore keeps keys in the memory of the current process. Tokens signed by one replica cannot be verified by
+// others, and they become invalid when the process restarts.
+type MemoryKeyStore struct {
+	mutex sync.Mutex
+	keys  []*SigningKey
+}
+
+func (s *MemoryKeyStore) List() ([]*SigningKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*SigningKey(nil), s.keys...), nil
+}
+
+func (s *MemoryKeyStore) Add(key *SigningKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = append(s.keys, key)
+	return nil
+}
+
+func (s *MemoryKeyStore) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, key := range s.keys {
+		if key.Id == id {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KEY_RETENTION is how long a key remains valid for verification after it has been replaced. It must not be shorter
+// than the lifetime of any signed token.
+const KEY_RETENTION = time.Hour * 24
+
+// KEY_RELOAD_INTERVAL is how often keys are reloaded from the key store, which picks up rotations by other replicas.
+const KEY_RELOAD_INTERVAL = time.Minute
+
+var (
+	ErrKeyNotFound = errors.New("Key not found")
+
+	keys = &keyRing{}
+)
+
+type SigningKey struct {
+	Id           string
+	PrivateKey   *rsa.PrivateKey
+	CreationTime time.Time
+}
+
+type KeyStore interface {
+	List() ([]*SigningKey, error)
+	Add(*SigningKey) error
+	Remove(id string) error
+}
+
+func SetKeyStore(store KeyStore) {
+	keys.setStore(store)
+}
+
+func NewSigningKey(now time.Time) (*SigningKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{keyId(&privateKey.PublicKey), privateKey, now}, nil
+}
+
+// keyId returns the JWK thumbprint (RFC 7638) of the public key.
+func keyId(key *rsa.PublicKey) string {
+	jwk := map[string]string{
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+	}
+	b, _ := json.Marshal(jwk) // Map keys are sorted, as required by RFC 7638.
+	hash := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func newJwk(key *SigningKey) *Jwk {
+	publicKey := &key.PrivateKey.PublicKey
+	return &Jwk{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: key.Id,
+		N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}
+}
+
+// keyRing caches the keys of a key store. The newest key signs, and all keys in the store verify.
+type keyRing struct {
+	mutex    sync.RWMutex
+	store    KeyStore
+	keys     []*SigningKey
+	loadTime time.Time
+}
+
+func (r *keyRing) setStore(store KeyStore) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.store = store
+	r.keys = nil
+	r.loadTime = time.Time{}
+}
+
+func (r *keyRing) list(reload bool) ([]*SigningKey, error) {
+	now := time.Now()
+	r.mutex.RLock()
+	if r.store == nil {
+		r.mutex.RUnlock()
+		return nil, nil
+	}
+	if !reload && now.Sub(r.loadTime) < KEY_RELOAD_INTERVAL {
+		defer r.mutex.RUnlock()
+		return r.keys, nil
+	}
+	r.mutex.RUnlock()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	keys, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreationTime.Before(keys[j].CreationTime)
+	})
+	r.keys = keys
+	r.loadTime = now
+	return keys, nil
+}
+
+func (r *keyRing) signingKey() (*SigningKey, error) {
+	keys, err := r.list(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return keys[len(keys)-1], nil
+}
+
+func (r *keyRing) verificationKey(id string) (*rsa.PublicKey, error) {
+	keys, err := r.list(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Id == id {
+			return &key.PrivateKey.PublicKey, nil
+		}
+	}
+
+	// The key may have just been created by another replica.
+	r.mutex.RLock()
+	recent := time.Since(r.loadTime) < time.Second
+	r.mutex.RUnlock()
+	if !recent {
+		if keys, err = r.list(true); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if key.Id == id {
+				return &key.PrivateKey.PublicKey, nil
+			}
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (r *keyRing) keyFunc(header *jwtHeader) (*rsa.PublicKey, error) {
+	return r.verificationKey(header.Kid)
+}
+
+// rotate creates a new signing key if the current one is older than the interval, or if there is none, and removes keys
+// that have been replaced for longer than KEY_RETENTION.
+func (r *keyRing) rotate(now time.Time, interval time.Duration) error {
+	r.mutex.RLock()
+	store := r.store
+	r.mutex.RUnlock()
+	if store == nil {
+		return ErrKeyNotFound
+	}
+
+	keys, err := r.list(true)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || now.Sub(keys[len(keys)-1].CreationTime) >= interval {
+		key, err := NewSigningKey(now)
+		if err != nil {
+			return err
+		}
+		if err := store.Add(key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	for i := 0; i < len(keys)-1; i++ {
+		if now.Sub(keys[i+1].CreationTime) >= KEY_RETENTION {
+			if err := store.Remove(keys[i].Id); err != nil && err != ErrKeyNotFound {
+				return err
+			}
+		}
+	}
+
+	_, err = r.list(true)
+	return err
+}
+
+// RotateKeys makes sure that there is a signing key that is younger than the interval.
+func RotateKeys(interval time.Duration) error {
+	return keys.rotate(time.Now(), interval)
+}
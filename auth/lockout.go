@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+const LOGIN_FAILURES_TICKET = "login_failures"
+
+// LockoutPolicy slows down password guessing. Once a username or a client address has failed UserThreshold or
+// AddressThreshold times, it is locked for BaseDelay after each further failure, doubling every time up to MaxDelay.
+// Failures are forgotten after Window without any.
+type LockoutPolicy struct {
+	UserThreshold    int
+	AddressThreshold int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	Window           time.Duration
+}
+
+var lockoutPolicy = LockoutPolicy{
+	UserThreshold:    5,
+	AddressThreshold: 20,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute * 15,
+	Window:           time.Hour,
+}
+
+func SetLockoutPolicy(policy LockoutPolicy) {
+	lockoutPolicy = policy
+}
+
+func userLockoutKey(username string) string {
+	return "user:" + username
+}
+
+func addressLockoutKey(address string) string {
+	return "address:" + address
+}
+
+// peerAddress returns the IP address of the client, without the port, which changes with every connection.
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// lockoutDelay returns how long to lock after the given number of failures.
+func lockoutDelay(count int32, threshold int) time.Duration {
+	if threshold <= 0 || int(count) < threshold {
+		return 0
+	}
+	exponent := float64(int(count) - threshold)
+	delay := float64(lockoutPolicy.BaseDelay) * math.Pow(2, exponent)
+	if delay > float64(lockoutPolicy.MaxDelay) {
+		return lockoutPolicy.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+func lockedUntil(key string, now time.Time) (time.Time, error) {
+	var failures LoginFailures
+	if err := getTicket(LOGIN_FAILURES_TICKET, key, &failures); err == ErrTicketNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	if failures.LockedUntil == nil {
+		return time.Time{}, nil
+	}
+	return ptypes.Timestamp(failures.LockedUntil)
+}
+
+// recordLoginFailure counts a failure of the key and locks it once the threshold is reached. Concurrent failures may be
+// undercounted, which only delays the lockout by a few attempts.
+func recordLoginFailure(key string, threshold int, now time.Time) error {
+	var failures LoginFailures
+	if err := getTicket(LOGIN_FAILURES_TICKET, key, &failures); err != nil && err != ErrTicketNotFound {
+		return err
+	}
+	failures.Count++
+	expirationTime := now.Add(lockoutPolicy.Window)
+	if delay := lockoutDelay(failures.Count, threshold); delay > 0 {
+		t, err := ptypes.TimestampProto(now.Add(delay))
+		if err != nil {
+			return err
+		}
+		failures.LockedUntil = t
+		if now.Add(delay).After(expirationTime) {
+			expirationTime = now.Add(delay)
+		}
+	}
+	return putTicket(LOGIN_FAILURES_TICKET, key, &failures, expirationTime)
+}
+
+// tooManyAttempts returns a ResourceExhausted error that tells the client when to retry, both in the message and as
+// RetryInfo in the details.
+func tooManyAttempts(retryAfter time.Duration) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	message := "Too many failed attempts, retry after " + strconv.FormatInt(seconds, 10) + " seconds"
+	s, err := status.New(codes.ResourceExhausted, message).
+		WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(time.Duration(seconds) * time.Second)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, message)
+	}
+	return s.Err()
+}
+
+// checkLockout fails if the username or the address of the client is locked.
+func checkLockout(ctx context.Context, username string, now time.Time) error {
+	keys := []string{userLockoutKey(username)}
+	if address := peerAddress(ctx); address != "" {
+		keys = append(keys, addressLockoutKey(address))
+	}
+	var retryAfter time.Duration
+	for _, key := range keys {
+		t, err := lockedUntil(key, now)
+		if err != nil {
+			return status.Error(codes.Internal, "Unable to check lockout")
+		}
+		if d := t.Sub(now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return tooManyAttempts(retryAfter)
+	}
+	return nil
+}
+
+func recordLoginFailures(ctx context.Context, username string, now time.Time) error {
+	if err := recordLoginFailure(userLockoutKey(username), lockoutPolicy.UserThreshold, now); err != nil {
+		return err
+	}
+	if address := peerAddress(ctx); address != "" {
+		return recordLoginFailure(addressLockoutKey(address), lockoutPolicy.AddressThreshold, now)
+	}
+	return nil
+}
+
+// resetLoginFailures forgets the failures of the username after a successful login. Those of the address are kept, so
+// that an attacker cannot reset them by logging in to an account of their own.
+func resetLoginFailures(username string) error {
+	if err := ticketStore.Delete(LOGIN_FAILURES_TICKET, userLockoutKey(username)); err != nil && err != ErrTicketNotFound {
+		return err
+	}
+	return nil
+}
+
+// CheckLockout is checkLockout for services other than the token endpoint that check passwords or codes of users, so
+// that they cannot be used to get around lockouts.
+func CheckLockout(ctx context.Context, username string) error {
+	return checkLockout(ctx, username, time.Now())
+}
+
+// RecordLoginFailure counts a failed check of such a service like a failed login.
+func RecordLoginFailure(ctx context.Context, username string) error {
+	return recordLoginFailures(ctx, username, time.Now())
+}
+
+// UnlockUser lets the user log in again right away, and forgets the failures so far.
+func UnlockUser(username string) error {
+	return resetLoginFailures(username)
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testLockoutPolicy = LockoutPolicy{
+	UserThreshold:    3,
+	AddressThreshold: 5,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Second * 10,
+	Window:           time.Hour,
+}
+
+// useTestLockoutPolicy starts from an empty ticket store with testLockoutPolicy, and returns a function that restores
+// the previous policy.
+func useTestLockoutPolicy() func() {
+	SetTicketStore(NewMemoryTicketStore())
+	previous := lockoutPolicy
+	SetLockoutPolicy(testLockoutPolicy)
+	return func() { SetLockoutPolicy(previous) }
+}
+
+func peerContext(address string) context.Context {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		panic(err)
+	}
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+}
+
+// expectLocked checks that the error is ResourceExhausted and tells to retry after the given number of seconds.
+func expectLocked(t *testing.T, name string, err error, seconds int64) {
+	s, ok := status.FromError(err)
+	if err == nil || !ok || s.Code() != codes.ResourceExhausted {
+		t.Errorf("%s: expected locked, got %v", name, err)
+		return
+	}
+	for _, detail := range s.Details() {
+		if retryInfo, ok := detail.(*errdetails.RetryInfo); ok {
+			if d, err := ptypes.Duration(retryInfo.RetryDelay); err != nil || d != time.Duration(seconds)*time.Second {
+				t.Errorf("%s: expected retry after %ds, got %v", name, seconds, retryInfo.RetryDelay)
+			}
+			return
+		}
+	}
+	t.Errorf("%s: RetryInfo missing from %v", name, s.Details())
+}
+
+func TestLockoutDelay(t *testing.T) {
+	defer useTestLockoutPolicy()()
+	tests := []struct {
+		count     int32
+		threshold int
+		delay     time.Duration
+	}{
+		{0, 3, 0},
+		{2, 3, 0},
+		{3, 3, time.Second},
+		{4, 3, time.Second * 2},
+		{5, 3, time.Second * 4},
+		{6, 3, time.Second * 8},
+		{7, 3, time.Second * 10},
+		// Large counts must not overflow past MaxDelay.
+		{1000, 3, time.Second * 10},
+		// A threshold of 0 disables the lockout.
+		{1000, 0, 0},
+	}
+	for _, test := range tests {
+		if delay := lockoutDelay(test.count, test.threshold); delay != test.delay {
+			t.Errorf("lockoutDelay(%d, %d): expected %v, got %v", test.count, test.threshold, test.delay, delay)
+		}
+	}
+}
+
+func TestLockoutUser(t *testing.T) {
+	defer useTestLockoutPolicy()()
+	ctx := peerContext("192.0.2.1:1234")
+	now := time.Now()
+
+	for i := 0; i < testLockoutPolicy.UserThreshold-1; i++ {
+		if err := recordLoginFailures(ctx, "alice", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkLockout(ctx, "alice", now); err != nil {
+		t.Errorf("expected alice not locked below the threshold, got %v", err)
+	}
+
+	if err := recordLoginFailures(ctx, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+	expectLocked(t, "at the threshold", checkLockout(ctx, "alice", now), 1)
+	// Locking the user does not lock anyone else from the same address.
+	if err := checkLockout(ctx, "bob", now); err != nil {
+		t.Errorf("expected bob not locked, got %v", err)
+	}
+	if err := checkLockout(ctx, "alice", now.Add(time.Second)); err != nil {
+		t.Errorf("expected alice unlocked after the delay, got %v", err)
+	}
+
+	// Each further failure doubles the delay.
+	now = now.Add(time.Second)
+	if err := recordLoginFailures(ctx, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+	expectLocked(t, "above the threshold", checkLockout(ctx, "alice", now), 2)
+	expectLocked(t, "during the delay", checkLockout(ctx, "alice", now.Add(time.Millisecond*1500)), 1)
+
+	if err := UnlockUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLockout(ctx, "alice", now); err != nil {
+		t.Errorf("expected alice unlocked, got %v", err)
+	}
+}
+
+func TestLockoutAddress(t *testing.T) {
+	defer useTestLockoutPolicy()()
+	now := time.Now()
+
+	// Failures of different users from the same address add up, whatever port they come from.
+	for i := 0; i < testLockoutPolicy.AddressThreshold; i++ {
+		ctx := peerContext("192.0.2.1:" + strconv.Itoa(1000+i))
+		if err := recordLoginFailures(ctx, "user"+strconv.Itoa(i), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLocked(t, "address at the threshold", checkLockout(peerContext("192.0.2.1:80"), "carol", now), 1)
+	if err := checkLockout(peerContext("192.0.2.2:80"), "carol", now); err != nil {
+		t.Errorf("expected other address not locked, got %v", err)
+	}
+	// Without a known address, only the user is checked.
+	if err := checkLockout(context.Background(), "carol", now); err != nil {
+		t.Errorf("expected carol not locked, got %v", err)
+	}
+
+	// Logging in successfully does not reset the failures of the address.
+	if err := resetLoginFailures("user0"); err != nil {
+		t.Fatal(err)
+	}
+	expectLocked(t, "address after reset", checkLockout(peerContext("192.0.2.1:80"), "user0", now), 1)
+}
+
+func TestLockoutWindow(t *testing.T) {
+	defer useTestLockoutPolicy()()
+	ctx := peerContext("192.0.2.1:1234")
+	now := time.Now()
+
+	// Failures from longer than the window ago are forgotten.
+	before := now.Add(-testLockoutPolicy.Window - time.Second)
+	for i := 0; i < testLockoutPolicy.UserThreshold-1; i++ {
+		if err := recordLoginFailures(ctx, "alice", before); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recordLoginFailures(ctx, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLockout(ctx, "alice", now); err != nil {
+		t.Errorf("expected old failures forgotten, got %v", err)
+	}
+
+	// Those within the window add up.
+	for i := 0; i < testLockoutPolicy.UserThreshold-1; i++ {
+		if err := recordLoginFailures(ctx, "alice", now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLocked(t, "within the window", checkLockout(ctx, "alice", now.Add(time.Minute)), 1)
+}
+
+func TestTooManyAttempts(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		seconds    int64
+		message    string
+	}{
+		{time.Second, 1, "Too many failed attempts, retry after 1 seconds"},
+		// Clients retrying early would only be locked again, so partial seconds are rounded up.
+		{time.Millisecond * 1500, 2, "Too many failed attempts, retry after 2 seconds"},
+		{time.Millisecond, 1, "Too many failed attempts, retry after 1 seconds"},
+		{time.Minute * 15, 900, "Too many failed attempts, retry after 900 seconds"},
+	}
+	for _, test := range tests {
+		err := tooManyAttempts(test.retryAfter)
+		expectLocked(t, test.retryAfter.String(), err, test.seconds)
+		if s, _ := status.FromError(err); s.Message() != test.message {
+			t.Errorf("%v: unexpected message %q", test.retryAfter, s.Message())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	MFA_TOKEN_EXPIRATION = time.Minute * 5
+	MFA_TOKEN_TICKET     = "mfa_token"
+	TOTP_TICKET          = "totp"
+)
+
+var ErrIncorrectCode = errors.New("Incorrect code")
+
+// mfaUserStore keeps the second factors of users.
+type mfaUserStore interface {
+	GetUserInfo(username string) (*UserInfo, error)
+	// GetTotpSecret returns the TOTP secret of the user, or an empty string if TOTP is not enabled.
+	GetTotpSecret(username string) (string, error)
+	// UseRecoveryCode invalidates the recovery code of the user, or returns ErrIncorrectCode if there is no such code.
+	UseRecoveryCode(username string, code string) error
+}
+
+// mfaRequired returns the mfa_required error, whose details carry the mfa token that the client exchanges for the actual
+// token once the user has entered a code.
+func mfaRequired(authToken *AuthToken) error {
+	mfaToken, err := generateToken()
+	if err != nil {
+		return status.Error(codes.Internal, "Unable to generate mfa token")
+	}
+	ticket := MfaTicket{ClientId: authToken.ClientId, UserId: authToken.UserId, Scope: authToken.Scope}
+	if err := putTicket(MFA_TOKEN_TICKET, mfaToken, &ticket, time.Now().Add(MFA_TOKEN_EXPIRATION)); err != nil {
+		return status.Error(codes.Internal, "Unable to store mfa token")
+	}
+	s, err := status.New(codes.Unauthenticated, "mfa_required").WithDetails(&MfaRequired{MfaToken: mfaToken})
+	if err != nil {
+		return status.Error(codes.Internal, "Unable to require mfa")
+	}
+	return s.Err()
+}
+
+type MfaGrantTypeHandler struct {
+	UserStore mfaUserStore
+}
+
+func (h *MfaGrantTypeHandler) verifyTotp(userId string, otp string, now time.Time) error {
+	secret, err := h.UserStore.GetTotpSecret(userId)
+	if err != nil {
+		return err
+	}
+	return UseTotp(userId, secret, otp, now)
+}
+
+func (h *MfaGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, error) {
+	var err error
+	var authToken AuthToken
+	now := time.Now()
+
+	if r.GrantType != GrantType_mfa.String() {
+		return nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
+	}
+
+	clientAuthToken, ok := GetAuthToken(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated")
+	}
+
+	var ticket MfaTicket
+	if err := getTicket(MFA_TOKEN_TICKET, r.MfaToken, &ticket); err == ErrTicketNotFound {
+		return nil, status.Error(codes.Unauthenticated, "Invalid mfa token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch mfa token")
+	}
+	if ticket.ClientId != clientAuthToken.ClientId {
+		return nil, status.Error(codes.Unauthenticated, "Invalid mfa token")
+	}
+
+	if err := checkLockout(ctx, ticket.UserId, now); err != nil {
+		return nil, err
+	}
+	if r.RecoveryCode != "" {
+		err = h.UserStore.UseRecoveryCode(ticket.UserId, r.RecoveryCode)
+	} else {
+		err = h.verifyTotp(ticket.UserId, r.Otp, now)
+	}
+	if err == ErrIncorrectCode || err == ErrUserNotFound {
+		if err := recordLoginFailures(ctx, ticket.UserId, now); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to record failure")
+		}
+		return nil, status.Error(codes.Unauthenticated, "Incorrect code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to verify code")
+	}
+
+	// The user may have been disabled or had their scope reduced since the password was checked.
+	userInfo, err := h.UserStore.GetUserInfo(ticket.UserId)
+	if err == ErrUserDisabled {
+		return nil, status.Error(codes.PermissionDenied, "User disabled")
+	} else if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid mfa token")
+	}
+
+	if err := resetLoginFailures(ticket.UserId); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to reset failures")
+	}
+	if err := recordLogin(h.UserStore, ticket.UserId, now); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to record login")
+	}
+
+	// The mfa token may be retried with another code until it expires, but only be exchanged once.
+	if err := ticketStore.Delete(MFA_TOKEN_TICKET, r.MfaToken); err == ErrTicketNotFound {
+		return nil, status.Error(codes.Unauthenticated, "Invalid mfa token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch mfa token")
+	}
+
+	authToken.ClientId = ticket.ClientId
+	authToken.UserId = ticket.UserId
+	authToken.Scope = narrowUserScope(ticket.Scope, userInfo)
+
+	if err := issueAccessToken(ctx, &authToken, now, USER_TOKEN_EXPIRATION); err != nil {
+		return nil, err
+	}
+
+	authToken.Refresh, err = generateToken()
+	if err != nil {
+		return nil, err
+	}
+	authToken.RefreshExpirationTime, err = ptypes.TimestampProto(now.Add(REFRESH_TOKEN_EXPIRATION))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
+
+	return &authToken, nil
+}
+
+func (h *MfaGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, err := h.createAuthToken(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenResponse(authToken)
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// peerCertificate returns the client certificate of the connection, if the client presented one and it was verified
+// against the client CA.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsInfo.State.PeerCertificates[0]
+}
+
+// certificateThumbprint is the base64url encoded SHA-256 hash of the certificate, as in the "x5t#S256" confirmation
+// method of RFC 8705.
+func certificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func peerCertificateThumbprint(ctx context.Context) string {
+	if cert := peerCertificate(ctx); cert != nil {
+		return certificateThumbprint(cert)
+	}
+	return ""
+}
+
+// authenticateClientCertificate implements the tls_client_auth method of RFC 8705, where the client id is the common
+// name of the subject of the client certificate.
+func authenticateClientCertificate(ctx context.Context, store clientStore, clientId string) (string, *ClientInfo, error) {
+	cert := peerCertificate(ctx)
+	if cert == nil {
+		return "", nil, status.Error(codes.Unauthenticated, "No client certificate")
+	}
+	if clientId != "" && clientId != cert.Subject.CommonName {
+		return "", nil, status.Error(codes.Unauthenticated, "Client certificate does not match client")
+	}
+	clientInfo, err := store.GetClientInfo(cert.Subject.CommonName)
+	if err != nil {
+		return "", nil, status.Error(codes.Unauthenticated, "Client certificate does not match client")
+	}
+	return cert.Subject.CommonName, clientInfo, nil
+}
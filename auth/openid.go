@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+)
+
+var (
+	issuer = "http://localhost:8080"
+)
+
+// SetIssuer sets the issuer of ID tokens, which is also the base URL of the endpoints in the OpenID configuration.
+func SetIssuer(i string) {
+	issuer = i
+}
+
+// idTokenClaims are the claims of an OpenID Connect ID token, which tells the client who the user is.
+type idTokenClaims struct {
+	Issuer     string `json:"iss"`
+	Subject    string `json:"sub"`
+	Audience   string `json:"aud"`
+	IssuedAt   int64  `json:"iat"`
+	Expiration int64  `json:"exp"`
+	Nonce      string `json:"nonce,omitempty"`
+}
+
+// issueIdToken signs an ID token for the user of the token, which expires together with the access token. It returns an
+// empty string unless the openid scope is granted on behalf of a user.
+func issueIdToken(authToken *AuthToken, nonce string) (string, error) {
+	if authToken.UserId == "" || !HasScope(Scope_openid, authToken) {
+		return "", nil
+	}
+	issuedAt, err := ptypes.Timestamp(authToken.AccessCreationTime)
+	if err != nil {
+		return "", err
+	}
+	expiration, err := ptypes.Timestamp(authToken.AccessExpirationTime)
+	if err != nil {
+		return "", err
+	}
+	key, err := keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+	claims := idTokenClaims{
+		Issuer:     issuer,
+		Subject:    authToken.UserId,
+		Audience:   authToken.ClientId,
+		IssuedAt:   issuedAt.Unix(),
+		Expiration: expiration.Unix(),
+		Nonce:      nonce,
+	}
+	return signJWT(jwtHeader{Kid: key.Id}, &claims, key.PrivateKey)
+}
+
+// UserInfo implements the UserInfo endpoint of OpenID Connect, returning the claims about the user of the token.
+func (c *AuthService) UserInfo(ctx context.Context, r *UserInfoRequest) (*UserInfoResponse, error) {
+	authToken, ok := GetAuthToken(ctx)
+	if !ok || authToken.UserId == "" {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated as a user")
+	}
+	userInfo, err := c.UserStore.GetUserInfo(authToken.UserId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	return &UserInfoResponse{
+		Sub:               authToken.UserId,
+		PreferredUsername: authToken.UserId,
+		Email:             userInfo.Email,
+		Name:              userInfo.DisplayName,
+	}, nil
+}
+
+// tokenEndpointAuthMethods are those that all grant types with client authentication at the token endpoint accept. JWT
+// assertions (private_key_jwt) and client certificates (tls_client_auth) only work with the client_credentials grant
+// type, so they are not advertised.
+var tokenEndpointAuthMethods = []string{"client_secret_basic", "client_secret_post", "none"}
+
+// GetOpenIdConfiguration returns the OpenID Connect discovery document, so that clients can find the endpoints and
+// capabilities of the server.
+func (c *AuthService) GetOpenIdConfiguration(ctx context.Context, r *GetOpenIdConfigurationRequest) (*OpenIdConfiguration, error) {
+	var scopes []string
+	for i := 0; i < len(Scope_name); i++ {
+		scopes = append(scopes, Scope(i).String())
+	}
+	var grantTypes []string
+	for grantType := range c.GrantTypeHandlers {
+		if grantType == GRANT_TYPE_DEVICE_CODE && c.DeviceVerificationUri == "" {
+			continue
+		}
+		grantTypes = append(grantTypes, grantType)
+	}
+	sort.Strings(grantTypes)
+
+	resp := OpenIdConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/tokens",
+		UserinfoEndpoint:                  issuer + "/oauth/userinfo",
+		JwksUri:                           issuer + "/.well-known/jwks.json",
+		RegistrationEndpoint:              issuer + "/oauth/register",
+		RevocationEndpoint:                issuer + "/oauth/revoke",
+		IntrospectionEndpoint:             issuer + "/oauth/introspect",
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               grantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: tokenEndpointAuthMethods,
+		CodeChallengeMethodsSupported:     []string{"S256", "plain"},
+	}
+	if c.DeviceVerificationUri != "" {
+		resp.DeviceAuthorizationEndpoint = issuer + "/oauth/device_authorization"
+	}
+	return &resp, nil
+}
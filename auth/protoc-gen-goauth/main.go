@@ -43,14 +43,14 @@ var (
 {{range $md := $svc.Methods}}
 {{if (or ($md.AuthChecker.GetAuthenticated) ($md.AuthChecker.GetScope))}}
 func (r *{{.Request}}) isAuthenticated(ctx context.Context) bool {
-	_, ok := auth.GetAuthToken(ctx)
+	_, ok := {{$.AuthPkg}}GetAuthToken(ctx)
 	return ok
 }
 {{end}}
 {{if $md.AuthChecker.GetScope}}
 func (r *{{.Request}}) HasScope(ctx context.Context) bool {
-	token, _ := auth.GetAuthToken(ctx)
-	return {{range $s := $md.AuthChecker.GetScope}}auth.HasScope(auth.Scope_{{$s}}, token) && {{end}}true
+	token, _ := {{$.AuthPkg}}GetAuthToken(ctx)
+	return {{range $s := $md.AuthChecker.GetScope}}{{$.AuthPkg}}HasScope({{$.AuthPkg}}Scope_{{$s}}, token) && {{end}}true
 }
 {{end}}
 
@@ -86,6 +86,7 @@ type TemplateData struct {
 	Pkg           string
 	Services      []Service
 	IsSamePackage bool
+	AuthPkg       string // Qualifier of identifiers in the auth package, empty within the auth package itself
 }
 
 type Params struct {
@@ -124,10 +125,15 @@ func createTemplateData(params Params, file *descriptor.FileDescriptorProto) Tem
 			mds,
 		})
 	}
+	authPkg := "auth."
+	if params.IsAuthPackage {
+		authPkg = ""
+	}
 	return TemplateData{
 		*file.Package,
 		svcs,
 		params.IsAuthPackage,
+		authPkg,
 	}
 }
 
@@ -151,8 +157,14 @@ func main() {
 
 	var files []*plugin.CodeGeneratorResponse_File
 	params := parseParams(gen.Request.GetParameter())
+	toGenerate := make(map[string]bool)
+	for _, name := range gen.Request.FileToGenerate {
+		toGenerate[name] = true
+	}
+
 	for _, file := range gen.Request.GetProtoFile() {
-		if len(file.GetService()) > 0 {
+		// Imported files, such as auth.proto, are generated separately with their own parameters.
+		if toGenerate[file.GetName()] && len(file.GetService()) > 0 {
 			code := bytes.NewBuffer(nil)
 			data := createTemplateData(params, file)
 			if err := authTemplate.Execute(code, data); err != nil {
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const REFRESH_TOKEN_EXPIRATION = time.Hour * 24 * 30
+
+type RefreshTokenGrantTypeHandler struct {
+	UserStore userStore
+}
+
+func (h *RefreshTokenGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, error) {
+	var err error
+	var authToken AuthToken
+	now := time.Now()
+
+	if r.GrantType != GrantType_refresh_token.String() {
+		return nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
+	}
+
+	clientAuthToken, ok := GetAuthToken(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated")
+	}
+	if !HasScope(Scope_user_authorize, clientAuthToken) {
+		return nil, status.Error(codes.Unauthenticated, "Insufficient scope")
+	}
+
+	oldAuthToken, err := getRefreshAuthToken(r.RefreshToken)
+	if err != nil || oldAuthToken.ClientId != clientAuthToken.ClientId {
+		return nil, status.Error(codes.Unauthenticated, "Invalid refresh token")
+	}
+	if isExpired(oldAuthToken.RefreshExpirationTime, now) {
+		return nil, status.Error(codes.Unauthenticated, "Refresh token expired")
+	}
+
+	// The user may have been removed or had their scope changed since the refresh token was issued.
+	userInfo, err := h.UserStore.GetUserInfo(oldAuthToken.UserId)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid refresh token")
+	}
+
+	authToken.ClientId = oldAuthToken.ClientId
+	authToken.UserId = oldAuthToken.UserId
+	authToken.Scope = narrowUserScope(oldAuthToken.Scope, userInfo)
+
+	if err := issueAccessToken(ctx, &authToken, now, USER_TOKEN_EXPIRATION); err != nil {
+		return nil, err
+	}
+
+	authToken.Refresh, err = generateToken()
+	if err != nil {
+		return nil, err
+	}
+	authToken.RefreshExpirationTime, err = ptypes.TimestampProto(now.Add(REFRESH_TOKEN_EXPIRATION))
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh tokens are single use. Only the request that manages to revoke the old pair gets the new one.
+	if err := removeAuthToken(*oldAuthToken); err == ErrTokenNotFound {
+		return nil, status.Error(codes.Unauthenticated, "Invalid refresh token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to revoke token")
+	}
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
+
+	return &authToken, nil
+}
+
+func (h *RefreshTokenGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, err := h.createAuthToken(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return createTokenResponse(authToken)
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/url"
+	"time"
+)
+
+func generateClientId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validateRedirectUri(redirectUri string) error {
+	u, err := url.Parse(redirectUri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return status.Error(codes.InvalidArgument, "Invalid redirect uri "+redirectUri)
+	}
+	return nil
+}
+
+func (c *AuthService) validateRegistration(r *RegisterClientRequest) ([]string, []Scope, error) {
+	grantTypes := r.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{GrantType_client_credentials.String()}
+	}
+	for _, grantType := range grantTypes {
+		if _, ok := c.GrantTypeHandlers[grantType]; !ok {
+			return nil, nil, status.Error(codes.InvalidArgument, "Unsupported grant type "+grantType)
+		}
+	}
+
+	switch r.TokenEndpointAuthMethod {
+	case "", "client_secret_basic", "client_secret_post":
+	case "none":
+		// Public clients have no credentials to obtain tokens of their own with.
+		for _, grantType := range grantTypes {
+			if grantType == GrantType_client_credentials.String() {
+				return nil, nil, status.Error(codes.InvalidArgument, "Public clients cannot use the client_credentials grant type")
+			}
+		}
+	default:
+		return nil, nil, status.Error(codes.InvalidArgument, "Unsupported token endpoint auth method "+r.TokenEndpointAuthMethod)
+	}
+
+	scope, err := ParseScope(r.Scope)
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(scope) == 0 {
+		scope = c.RegistrationScopes
+	}
+	for _, s := range scope {
+		if !containsScope(c.RegistrationScopes, s) {
+			return nil, nil, status.Error(codes.PermissionDenied, "Scope not allowed for registration: "+s.String())
+		}
+	}
+
+	for _, redirectUri := range r.RedirectUris {
+		if err := validateRedirectUri(redirectUri); err != nil {
+			return nil, nil, err
+		}
+	}
+	return grantTypes, scope, nil
+}
+
+// RegisterClient implements RFC 7591. The caller needs an initial access token, i.e., a client token with the
+// client_registration scope, so that clients cannot be registered anonymously. Public clients are registered without a
+// secret.
+func (c *AuthService) RegisterClient(ctx context.Context, r *RegisterClientRequest) (*RegisterClientResponse, error) {
+	grantTypes, scope, err := c.validateRegistration(r)
+	if err != nil {
+		return nil, err
+	}
+
+	clientId, err := generateClientId()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate client id")
+	}
+	authMethod := r.TokenEndpointAuthMethod
+	if authMethod == "" {
+		authMethod = "client_secret_basic"
+	}
+	var clientSecret string
+	if authMethod != "none" {
+		if clientSecret, err = generateToken(); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to generate client secret")
+		}
+	}
+
+	clientInfo := ClientInfo{Scope: scope, Name: r.ClientName, GrantTypes: grantTypes, RedirectUris: r.RedirectUris}
+	if err := c.ClientRegistry.CreateClient(clientId, clientSecret, &clientInfo); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to create client")
+	}
+
+	return &RegisterClientResponse{
+		ClientId:                clientId,
+		ClientSecret:            clientSecret,
+		ClientIdIssuedAt:        time.Now().Unix(),
+		ClientName:              r.ClientName,
+		GrantTypes:              grantTypes,
+		Scope:                   scopeString(scope),
+		RedirectUris:            r.RedirectUris,
+		TokenEndpointAuthMethod: authMethod,
+	}, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// findAuthToken looks a token up as the kind indicated by the hint first, and then as the other kind.
+func findAuthToken(token string, tokenTypeHint string) (*AuthToken, error) {
+	lookups := []func(string) (*AuthToken, error){tokenStore.Get, tokenStore.GetByRefresh}
+	if tokenTypeHint == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	for _, lookup := range lookups {
+		if authToken, err := lookup(token); err != ErrTokenNotFound {
+			return authToken, err
+		}
+	}
+	return nil, ErrTokenNotFound
+}
+
+// RevokeToken implements RFC 7009. An access token and its refresh token are stored together, so revoking either one
+// also revokes the other. Since refreshing replaces the previous access token, this covers every access token that was
+// obtained with the refresh token. JWT access tokens are verified without the token store, so their ids are denied as
+// well until they expire. Clients authenticate like at the token endpoint, so that public clients and those with
+// certificates or assertions can revoke their tokens as well.
+func (c *AuthService) RevokeToken(ctx context.Context, r *RevokeTokenRequest) (*RevokeTokenResponse, error) {
+	clientId, _, err := authenticateAnyClient(ctx, c.ClientStore, r.ClientId, r.ClientSecret, r.ClientAssertionType, r.ClientAssertion, c.TokenEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	authToken, err := findAuthToken(r.Token, r.TokenTypeHint)
+	if err == ErrTokenNotFound {
+		// Per the RFC, unknown tokens are not an error, since the purpose of the request has been achieved.
+		return &RevokeTokenResponse{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch token")
+	}
+	if authToken.ClientId != clientId {
+		return nil, status.Error(codes.PermissionDenied, "Token was issued to another client")
+	}
+
+	if err := removeAuthToken(*authToken); err != nil && err != ErrTokenNotFound {
+		return nil, status.Error(codes.Internal, "Unable to revoke token")
+	}
+	return &RevokeTokenResponse{}, nil
+}
+
+// RevokeUserTokens revokes every token of the user, e.g., after a password change, including JWT access tokens.
+func RevokeUserTokens(userId string) error {
+	authTokens, err := tokenStore.ListByUser(userId)
+	if err != nil {
+		return err
+	}
+	return removeAuthTokens(authTokens)
+}
+
+// RevokeClientTokens revokes every token issued to the client, e.g., after its secret has been rotated.
+func RevokeClientTokens(clientId string) error {
+	authTokens, err := tokenStore.ListByClient(clientId)
+	if err != nil {
+		return err
+	}
+	return removeAuthTokens(authTokens)
+}
+
+// removeAuthTokens ignores tokens that have been revoked in the meantime.
+func removeAuthTokens(authTokens []*AuthToken) error {
+	for _, authToken := range authTokens {
+		if err := removeAuthToken(*authToken); err != nil && err != ErrTokenNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"testing"
+)
+
+// newStoredToken adds an opaque token with a refresh token for the client to the token store.
+func newStoredToken(t *testing.T, clientId string) *AuthToken {
+	access, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authToken := AuthToken{Access: access, Refresh: refresh, ClientId: clientId, UserId: "alice"}
+	if err := addAuthToken(authToken); err != nil {
+		t.Fatal(err)
+	}
+	return &authToken
+}
+
+func TestRevokeTokenClientAuthentication(t *testing.T) {
+	SetTokenStore(NewMemoryTokenStore())
+	SetTicketStore(NewMemoryTicketStore())
+	c := &AuthService{ClientStore: fakeClientStore{
+		"confidential": newConfidentialClient(t, "secret"),
+		"public":       &ClientInfo{},
+	}}
+
+	tests := []struct {
+		name         string
+		owner        string
+		clientId     string
+		clientSecret string
+		code         codes.Code
+	}{
+		{"confidential client", "confidential", "confidential", "secret", codes.OK},
+		{"public client", "public", "public", "", codes.OK},
+		{"incorrect secret", "confidential", "confidential", "incorrect", codes.Unauthenticated},
+		{"missing secret", "confidential", "confidential", "", codes.Unauthenticated},
+		{"unknown client", "confidential", "unknown", "", codes.Unauthenticated},
+		{"token of another client", "confidential", "public", "", codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		authToken := newStoredToken(t, test.owner)
+		_, err := c.RevokeToken(context.Background(), &RevokeTokenRequest{
+			Token:        authToken.Access,
+			ClientId:     test.clientId,
+			ClientSecret: test.clientSecret,
+		})
+		if errorCode(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.name, test.code, err)
+		}
+		_, err = tokenStore.Get(authToken.Access)
+		if revoked := err == ErrTokenNotFound; revoked != (test.code == codes.OK) {
+			t.Errorf("%s: token revoked %v", test.name, revoked)
+		}
+	}
+}
+
+func TestRevokeTokenCascades(t *testing.T) {
+	c := &AuthService{ClientStore: fakeClientStore{"public": &ClientInfo{}}}
+	tests := []struct {
+		name          string
+		refresh       bool
+		tokenTypeHint string
+	}{
+		{"access token", false, ""},
+		{"refresh token", true, ""},
+		{"refresh token with hint", true, "refresh_token"},
+		// Hints are only hints, so a wrong one still finds the token.
+		{"refresh token with wrong hint", true, "access_token"},
+		{"access token with wrong hint", false, "refresh_token"},
+	}
+	for _, test := range tests {
+		SetTokenStore(NewMemoryTokenStore())
+		SetTicketStore(NewMemoryTicketStore())
+		authToken := newStoredToken(t, "public")
+		token := authToken.Access
+		if test.refresh {
+			token = authToken.Refresh
+		}
+		if _, err := c.RevokeToken(context.Background(), &RevokeTokenRequest{Token: token, TokenTypeHint: test.tokenTypeHint, ClientId: "public"}); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if _, err := tokenStore.Get(authToken.Access); err != ErrTokenNotFound {
+			t.Errorf("%s: expected access token revoked, got %v", test.name, err)
+		}
+		if _, err := tokenStore.GetByRefresh(authToken.Refresh); err != ErrTokenNotFound {
+			t.Errorf("%s: expected refresh token revoked, got %v", test.name, err)
+		}
+		// Revoking again succeeds, since the token is gone either way.
+		if _, err := c.RevokeToken(context.Background(), &RevokeTokenRequest{Token: token, ClientId: "public"}); err != nil {
+			t.Errorf("%s: revoking again: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTicketNotFound = errors.New("Ticket not found")
+	ErrTicketExists   = errors.New("Ticket exists")
+)
+
+// TicketStore keeps short-lived records, such as authorization codes, that are identified by a kind and a key. Expired
+// tickets are never returned.
+type TicketStore interface {
+	Put(kind string, key string, value []byte, expirationTime time.Time) error
+	// Add is like Put, but fails with ErrTicketExists if a ticket that has not expired yet has the same kind and key.
+	Add(kind string, key string, value []byte, expirationTime time.Time) error
+	Get(kind string, key string) ([]byte, error)
+	// Take returns the ticket and deletes it at the same time, so that it can only be taken once.
+	Take(kind string, key string) ([]byte, error)
+	Delete(kind string, key string) error
+	PurgeExpired(now time.Time) (int, error)
+}
+
+var (
+	ticketStore TicketStore = NewMemoryTicketStore()
+)
+
+func SetTicketStore(store TicketStore) {
+	ticketStore = store
+}
+
+func putTicket(kind string, key string, ticket proto.Message, expirationTime time.Time) error {
+	value, err := proto.Marshal(ticket)
+	if err != nil {
+		return err
+	}
+	return ticketStore.Put(kind, key, value, expirationTime)
+}
+
+func getTicket(kind string, key string, ticket proto.Message) error {
+	value, err := ticketStore.Get(kind, key)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(value, ticket)
+}
+
+func takeTicket(kind string, key string, ticket proto.Message) error {
+	value, err := ticketStore.Take(kind, key)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(value, ticket)
+}
+
+type ticketKey struct {
+	kind string
+	key  string
+}
+
+type memoryTicket struct {
+	value          []byte
+	expirationTime time.Time
+}
+
+// MemoryTicketStore keeps tickets in the memory of the current process. It is safe for concurrent use, but tickets are
+// neither shared between replicas nor preserved across restarts.
+type MemoryTicketStore struct {
+	mutex   sync.Mutex
+	tickets map[ticketKey]memoryTicket
+}
+
+func NewMemoryTicketStore() *MemoryTicketStore {
+	return &MemoryTicketStore{tickets: make(map[ticketKey]memoryTicket)}
+}
+
+func (s *MemoryTicketStore) Put(kind string, key string, value []byte, expirationTime time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tickets[ticketKey{kind, key}] = memoryTicket{value, expirationTime}
+	return nil
+}
+
+func (s *MemoryTicketStore) Add(kind string, key string, value []byte, expirationTime time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k := ticketKey{kind, key}
+	if ticket, ok := s.tickets[k]; ok && time.Now().Before(ticket.expirationTime) {
+		return ErrTicketExists
+	}
+	s.tickets[k] = memoryTicket{value, expirationTime}
+	return nil
+}
+
+func (s *MemoryTicketStore) get(kind string, key string, remove bool) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k := ticketKey{kind, key}
+	ticket, ok := s.tickets[k]
+	if !ok {
+		return nil, ErrTicketNotFound
+	}
+	if !time.Now().Before(ticket.expirationTime) {
+		delete(s.tickets, k)
+		return nil, ErrTicketNotFound
+	}
+	if remove {
+		delete(s.tickets, k)
+	}
+	return ticket.value, nil
+}
+
+func (s *MemoryTicketStore) Get(kind string, key string) ([]byte, error) {
+	return s.get(kind, key, false)
+}
+
+func (s *MemoryTicketStore) Take(kind string, key string) ([]byte, error) {
+	return s.get(kind, key, true)
+}
+
+func (s *MemoryTicketStore) Delete(kind string, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k := ticketKey{kind, key}
+	if _, ok := s.tickets[k]; !ok {
+		return ErrTicketNotFound
+	}
+	delete(s.tickets, k)
+	return nil
+}
+
+func (s *MemoryTicketStore) PurgeExpired(now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for k, ticket := range s.tickets {
+		if !now.Before(ticket.expirationTime) {
+			delete(s.tickets, k)
+			count++
+		}
+	}
+	return count, nil
+}
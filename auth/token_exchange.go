@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	GRANT_TYPE_TOKEN_EXCHANGE = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TOKEN_TYPE_ACCESS_TOKEN   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// TokenExchangeGrantTypeHandler implements RFC 8693 for services that act on behalf of a user. The calling client
+// authenticates with its own token, which needs the token_exchange scope, and exchanges the user's token for one with
+// the same or a narrower scope. The new token records the calling client as the actor, along with the client that the
+// subject token was issued to. An actor token, if given, must have been issued to the calling client as well.
+type TokenExchangeGrantTypeHandler struct{}
+
+func verifyExchangedToken(token string, tokenType string) (*AuthToken, error) {
+	if tokenType != "" && tokenType != TOKEN_TYPE_ACCESS_TOKEN {
+		return nil, status.Error(codes.InvalidArgument, "Unsupported token type "+tokenType)
+	}
+	authToken, err := verifyAccessToken(token)
+	if err == ErrTokenNotFound {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+	return authToken, err
+}
+
+func (h *TokenExchangeGrantTypeHandler) createAuthToken(ctx context.Context, r *CreateTokenRequest) (*AuthToken, error) {
+	var authToken AuthToken
+	now := time.Now()
+
+	if r.GrantType != GRANT_TYPE_TOKEN_EXCHANGE {
+		return nil, status.Error(codes.Unauthenticated, "Unexpected grant type")
+	}
+
+	clientAuthToken, ok := GetAuthToken(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated")
+	}
+	if !HasScope(Scope_token_exchange, clientAuthToken) {
+		return nil, status.Error(codes.Unauthenticated, "Insufficient scope")
+	}
+
+	subjectAuthToken, err := verifyExchangedToken(r.SubjectToken, r.SubjectTokenType)
+	if err != nil {
+		return nil, err
+	}
+	// Client tokens would otherwise be exchanged for tokens of the calling client, with the scope of another client.
+	if subjectAuthToken.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Subject token is not a user token")
+	}
+	// Otherwise the calling client could name any client whose token it has obtained as the actor.
+	if r.ActorToken != "" {
+		actorAuthToken, err := verifyExchangedToken(r.ActorToken, r.ActorTokenType)
+		if err != nil {
+			return nil, err
+		}
+		if actorAuthToken.ClientId != clientAuthToken.ClientId {
+			return nil, status.Error(codes.PermissionDenied, "Actor token was issued to another client")
+		}
+	}
+	authToken.ActorClientId = clientAuthToken.ClientId
+	authToken.SubjectClientId = subjectAuthToken.ClientId
+
+	scope, err := ParseScope(r.Scope)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(scope) == 0 {
+		scope = subjectAuthToken.Scope
+	}
+	for _, s := range scope {
+		if !HasScope(s, subjectAuthToken) {
+			return nil, status.Error(codes.PermissionDenied, "Scope not granted to subject token: "+s.String())
+		}
+	}
+
+	authToken.ClientId = clientAuthToken.ClientId
+	authToken.UserId = subjectAuthToken.UserId
+	authToken.Scope = scope
+
+	// The new token must not outlive the one it was exchanged for.
+	expiration := USER_TOKEN_EXPIRATION
+	if t, err := ptypes.Timestamp(subjectAuthToken.AccessExpirationTime); err == nil && t.Sub(now) < expiration {
+		expiration = t.Sub(now)
+	}
+	if err := issueAccessToken(ctx, &authToken, now, expiration); err != nil {
+		return nil, err
+	}
+
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
+
+	return &authToken, nil
+}
+
+func (h *TokenExchangeGrantTypeHandler) CreateToken(ctx context.Context, r *CreateTokenRequest) (*CreateTokenResponse, error) {
+	authToken, err := h.createAuthToken(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := createTokenResponse(authToken)
+	if err != nil {
+		return nil, err
+	}
+	resp.IssuedTokenType = TOKEN_TYPE_ACCESS_TOKEN
+	return resp, nil
+}
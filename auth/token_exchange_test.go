@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"testing"
+	"time"
+)
+
+// issueTestToken issues an access token like the token endpoint does, and stores it.
+func issueTestToken(t *testing.T, clientId string, userId string, scope ...Scope) *AuthToken {
+	authToken := AuthToken{ClientId: clientId, UserId: userId, Scope: scope}
+	if err := issueAccessToken(context.Background(), &authToken, time.Now(), USER_TOKEN_EXPIRATION); err != nil {
+		t.Fatal(err)
+	}
+	if err := addAuthToken(authToken); err != nil {
+		t.Fatal(err)
+	}
+	return &authToken
+}
+
+func exchangeToken(clientAuthToken *AuthToken, subjectToken string, actorToken string) (*AuthToken, error) {
+	ctx := context.WithValue(context.Background(), "token", clientAuthToken)
+	return (&TokenExchangeGrantTypeHandler{}).createAuthToken(ctx, &CreateTokenRequest{
+		GrantType:    GRANT_TYPE_TOKEN_EXCHANGE,
+		SubjectToken: subjectToken,
+		ActorToken:   actorToken,
+	})
+}
+
+func TestTokenExchange(t *testing.T) {
+	for _, jwt := range []bool{false, true} {
+		SetTokenStore(NewMemoryTokenStore())
+		SetTicketStore(NewMemoryTicketStore())
+		restore := func() {}
+		if jwt {
+			restore = useJWTAccessTokens(t)
+		}
+
+		userToken := issueTestToken(t, "web", "alice", Scope_user_profile)
+		serviceToken := issueTestToken(t, "service", "", Scope_token_exchange)
+		otherServiceToken := issueTestToken(t, "other", "", Scope_token_exchange)
+
+		tests := []struct {
+			name         string
+			client       *AuthToken
+			subjectToken string
+			actorToken   string
+			code         codes.Code
+		}{
+			{"user token", serviceToken, userToken.Access, "", codes.OK},
+			{"actor token of the calling client", serviceToken, userToken.Access, serviceToken.Access, codes.OK},
+			{"actor token of another client", serviceToken, userToken.Access, otherServiceToken.Access, codes.PermissionDenied},
+			{"actor token of the subject client", serviceToken, userToken.Access, userToken.Access, codes.PermissionDenied},
+			{"invalid actor token", serviceToken, userToken.Access, "invalid", codes.Unauthenticated},
+			{"client token", serviceToken, otherServiceToken.Access, "", codes.InvalidArgument},
+			{"invalid subject token", serviceToken, "invalid", "", codes.Unauthenticated},
+			{"without token_exchange scope", userToken, userToken.Access, "", codes.Unauthenticated},
+		}
+		for _, test := range tests {
+			authToken, err := exchangeToken(test.client, test.subjectToken, test.actorToken)
+			if errorCode(err) != test.code {
+				t.Errorf("%s (jwt %v): expected %v, got %v", test.name, jwt, test.code, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			// The recorded clients must survive verification, which parses JWT access tokens without the token store.
+			verified, err := verifyAccessToken(authToken.Access)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verified.ClientId != "service" || verified.UserId != "alice" || verified.ActorClientId != "service" || verified.SubjectClientId != "web" {
+				t.Errorf("%s (jwt %v): unexpected token %+v", test.name, jwt, verified)
+			}
+		}
+		restore()
+	}
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"github.com/golang/protobuf/ptypes"
+	"sync"
+	"time"
+)
+
+var ErrTokenNotFound = errors.New("Token not found")
+
+type TokenStore interface {
+	Add(AuthToken) error
+	Get(access string) (*AuthToken, error)
+	GetByRefresh(refresh string) (*AuthToken, error)
+	Revoke(access string) error
+	ListByUser(userId string) ([]*AuthToken, error)
+	ListByClient(clientId string) ([]*AuthToken, error)
+	PurgeExpired(now time.Time) (int, error)
+}
+
+// ExpirationTime returns the time after which neither the access token nor the refresh token is usable anymore.
+func (t *AuthToken) ExpirationTime() time.Time {
+	expiration, _ := ptypes.Timestamp(t.AccessExpirationTime)
+	if t.Refresh != "" {
+		if refreshExpiration, err := ptypes.Timestamp(t.RefreshExpirationTime); err == nil && refreshExpiration.After(expiration) {
+			expiration = refreshExpiration
+		}
+	}
+	return expiration
+}
+
+// MemoryTokenStore keeps tokens in the memory of the current process. It is safe for concurrent use, but tokens are
+// neither shared between replicas nor preserved across restarts.
+type MemoryTokenStore struct {
+	mutex         sync.RWMutex
+	tokens        map[string]AuthToken
+	refreshTokens map[string]string
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:        make(map[string]AuthToken),
+		refreshTokens: make(map[string]string),
+	}
+}
+
+func (s *MemoryTokenStore) Add(authToken AuthToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[authToken.Access] = authToken
+	if authToken.Refresh != "" {
+		s.refreshTokens[authToken.Refresh] = authToken.Access
+	}
+	return nil
+}
+
+func (s *MemoryTokenStore) Get(access string) (*AuthToken, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	authToken, ok := s.tokens[access]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	return &authToken, nil
+}
+
+func (s *MemoryTokenStore) GetByRefresh(refresh string) (*AuthToken, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	access, ok := s.refreshTokens[refresh]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	authToken := s.tokens[access]
+	return &authToken, nil
+}
+
+func (s *MemoryTokenStore) Revoke(access string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	authToken, ok := s.tokens[access]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	delete(s.tokens, access)
+	if authToken.Refresh != "" {
+		delete(s.refreshTokens, authToken.Refresh)
+	}
+	return nil
+}
+
+func (s *MemoryTokenStore) ListByUser(userId string) ([]*AuthToken, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var authTokens []*AuthToken
+	for _, authToken := range s.tokens {
+		if authToken.UserId == userId {
+			t := authToken
+			authTokens = append(authTokens, &t)
+		}
+	}
+	return authTokens, nil
+}
+
+func (s *MemoryTokenStore) ListByClient(clientId string) ([]*AuthToken, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var authTokens []*AuthToken
+	for _, authToken := range s.tokens {
+		if authToken.ClientId == clientId {
+			t := authToken
+			authTokens = append(authTokens, &t)
+		}
+	}
+	return authTokens, nil
+}
+
+func (s *MemoryTokenStore) PurgeExpired(now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for access, authToken := range s.tokens {
+		if !now.Before(authToken.ExpirationTime()) {
+			delete(s.tokens, access)
+			if authToken.Refresh != "" {
+				delete(s.refreshTokens, authToken.Refresh)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	TOTP_PERIOD = time.Second * 30
+	TOTP_DIGITS = 6
+
+	// Codes of the previous and the next period are accepted as well, to allow for clock skew.
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTotpSecret returns a random 160-bit secret, base32 encoded as authenticator apps expect.
+func GenerateTotpSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TotpUri returns the otpauth URI of the secret, which authenticator apps usually scan as a QR code.
+func TotpUri(issuer string, account string, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("digits", strconv.Itoa(TOTP_DIGITS))
+	q.Set("period", strconv.Itoa(int(TOTP_PERIOD/time.Second)))
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// totpCode computes the code of the given period as in RFC 6238, with HMAC-SHA1.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulus)
+}
+
+// matchTotp returns the period that the code is valid for, if any.
+func matchTotp(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	counter := now.Unix() / int64(TOTP_PERIOD/time.Second)
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter+i)), []byte(code)) == 1 {
+			return counter + i, true
+		}
+	}
+	return 0, false
+}
+
+// UseTotp checks the code against the secret of the user, and returns ErrIncorrectCode if it does not match. Each code
+// can only be used once, so that an observed code cannot be replayed within its period.
+func UseTotp(userId string, secret string, code string, now time.Time) error {
+	counter, ok := matchTotp(secret, code, now)
+	if secret == "" || !ok {
+		return ErrIncorrectCode
+	}
+	expirationTime := time.Unix((counter+totpSkew+1)*int64(TOTP_PERIOD/time.Second), 0)
+	if err := ticketStore.Add(TOTP_TICKET, userId+":"+strconv.FormatInt(counter, 10), nil, expirationTime); err == ErrTicketExists {
+		return ErrIncorrectCode
+	} else {
+		return err
+	}
+}
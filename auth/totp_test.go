@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Key is the SHA1 seed of the test vectors in RFC 6238 Appendix B.
+var rfc6238Key = []byte("12345678901234567890")
+
+// rfc6238Vectors are the SHA1 test vectors of RFC 6238 Appendix B, truncated from 8 to 6 digits, which are the last 6
+// digits since both are the same value modulo a power of 10.
+var rfc6238Vectors = []struct {
+	time int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTotpCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		if code := totpCode(rfc6238Key, v.time/30); code != v.code {
+			t.Errorf("time %d: expected %s, got %s", v.time, v.code, code)
+		}
+	}
+}
+
+func TestMatchTotp(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+	for _, v := range rfc6238Vectors {
+		counter := v.time / 30
+		for _, skew := range []int64{-1, 0, 1} {
+			if c, ok := matchTotp(secret, v.code, time.Unix((counter+skew)*30, 0)); !ok || c != counter {
+				t.Errorf("time %d, skew %d: expected period %d, got %d, %v", v.time, skew, counter, c, ok)
+			}
+		}
+		for _, skew := range []int64{-2, 2} {
+			if _, ok := matchTotp(secret, v.code, time.Unix((counter+skew)*30, 0)); ok {
+				t.Errorf("time %d, skew %d: expected no match", v.time, skew)
+			}
+		}
+	}
+
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "287083"} {
+		if _, ok := matchTotp(secret, code, now); ok {
+			t.Errorf("code %q: expected no match", code)
+		}
+	}
+	if _, ok := matchTotp("not base32!", "287082", now); ok {
+		t.Error("invalid secret: expected no match")
+	}
+}
+
+func TestUseTotp(t *testing.T) {
+	SetTicketStore(NewMemoryTicketStore())
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+	// Used codes are kept until they expire, so the test runs at the current time rather than that of the vectors.
+	now := time.Now()
+	counter := now.Unix() / 30
+	code := totpCode(rfc6238Key, counter)
+
+	if err := UseTotp("alice", secret, code, now); err != nil {
+		t.Fatal(err)
+	}
+	// The same code cannot be used twice, not even in the next period, while it is still accepted for clock skew.
+	if err := UseTotp("alice", secret, code, now.Add(TOTP_PERIOD)); err != ErrIncorrectCode {
+		t.Errorf("replayed code: expected %v, got %v", ErrIncorrectCode, err)
+	}
+	// Codes are tracked per user.
+	if err := UseTotp("bob", secret, code, now); err != nil {
+		t.Errorf("other user: %v", err)
+	}
+	if err := UseTotp("alice", secret, totpCode(rfc6238Key, counter+1), now); err != nil {
+		t.Errorf("next code: %v", err)
+	}
+	if err := UseTotp("alice", secret, totpCode(rfc6238Key, counter-2), now); err != ErrIncorrectCode {
+		t.Errorf("expired code: expected %v, got %v", ErrIncorrectCode, err)
+	}
+	if err := UseTotp("carol", "", code, now); err != ErrIncorrectCode {
+		t.Errorf("no secret: expected %v, got %v", ErrIncorrectCode, err)
+	}
+}
@@ -2,27 +2,82 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/grpc-ecosystem/go-grpc-middleware/auth"
-	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"math"
-	"strings"
 	"time"
 )
 
 type UserInfo struct {
-	HashedPassword string
-	Scope          []Scope
+	Scope      []Scope
+	MfaEnabled bool // Whether the user has to enter a second factor after the password
+
+	// Profile claims, which are empty if the store does not know them
+	Email       string
+	DisplayName string
 }
 
+var (
+	ErrUserNotFound      = errors.New("User not found")
+	ErrIncorrectPassword = errors.New("Incorrect password")
+	ErrUserDisabled      = errors.New("User disabled")
+	ErrUserNotVerified   = errors.New("User not verified")
+
+	// ErrAmbiguousUser is returned by stores in which a username matches more than one user, so that a chain of stores
+	// neither falls through to the next store nor picks one of the users.
+	ErrAmbiguousUser = errors.New("User ambiguous")
+)
+
+// userStore looks up users. Implementations return ErrUserNotFound for unknown users, and ErrIncorrectPassword if the
+// password does not match, so that stores can be chained.
 type userStore interface {
-	GetUserInfo(string) (*UserInfo, error)
+	GetUserInfo(username string) (*UserInfo, error)
+	Authenticate(username string, password string) (*UserInfo, error)
+}
+
+// loginRecorder is implemented by user stores that keep the time of the last login of users.
+type loginRecorder interface {
+	RecordLogin(username string, now time.Time) error
+}
+
+func recordLogin(store interface{}, username string, now time.Time) error {
+	if recorder, ok := store.(loginRecorder); ok {
+		if err := recorder.RecordLogin(username, now); err != ErrUserNotFound {
+			return err
+		}
+	}
+	return nil
 }
 
 const USER_TOKEN_EXPIRATION = time.Hour * 24
 
+// grantUserScope returns the requested scope, or all of the granted scope if none is requested. Any user may request the
+// openid scope, which only adds an ID token to the response.
+func grantUserScope(requested []Scope, granted []Scope) ([]Scope, error) {
+	if len(requested) == 0 {
+		return granted, nil
+	}
+	for _, s := range requested {
+		if s != Scope_openid && !containsScope(granted, s) {
+			return nil, status.Error(codes.PermissionDenied, "Scope not granted to user: "+s.String())
+		}
+	}
+	return requested, nil
+}
+
+// narrowUserScope drops the scopes that the user no longer has from the scope of a previous grant.
+func narrowUserScope(scope []Scope, userInfo *UserInfo) []Scope {
+	var narrowed []Scope
+	for _, s := range scope {
+		if s == Scope_openid || containsScope(userInfo.Scope, s) {
+			narrowed = append(narrowed, s)
+		}
+	}
+	return narrowed
+}
+
 type UserPasswordGrantTypeHandler struct {
 	UserStore userStore
 }
@@ -47,26 +102,47 @@ func (h *UserPasswordGrantTypeHandler) createAuthToken(ctx context.Context, r *C
 
 	var password string
 	authToken.UserId, password, err = h.getUsernamePassword(ctx, r)
-	userInfo, err := h.UserStore.GetUserInfo(authToken.UserId)
 	if err != nil {
-		return nil, status.Error(codes.Unauthenticated, "Incorrect user id or password")
+		return nil, err
+	}
+	if err := checkLockout(ctx, authToken.UserId, now); err != nil {
+		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(userInfo.HashedPassword), []byte(password)); err != nil {
+	userInfo, err := h.UserStore.Authenticate(authToken.UserId, password)
+	if err == ErrUserNotFound || err == ErrIncorrectPassword || err == ErrAmbiguousUser {
+		// Unknown users are counted as well, so that lockouts do not reveal which users exist.
+		if err := recordLoginFailures(ctx, authToken.UserId, now); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to record failure")
+		}
 		return nil, status.Error(codes.Unauthenticated, "Incorrect user id or password")
+	} else if err == ErrUserDisabled {
+		return nil, status.Error(codes.PermissionDenied, "User disabled")
+	} else if err == ErrUserNotVerified {
+		return nil, status.Error(codes.FailedPrecondition, "Email not verified")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to authenticate user")
 	}
 
-	authToken.Scope = userInfo.Scope
-
-	authToken.Access, err = generateToken()
+	scope, err := ParseScope(r.Scope)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	authToken.AccessCreationTime, err = ptypes.TimestampProto(now)
-	if err != nil {
+	if authToken.Scope, err = grantUserScope(scope, userInfo.Scope); err != nil {
 		return nil, err
 	}
-	authToken.AccessExpirationTime, err = ptypes.TimestampProto(now.Add(USER_TOKEN_EXPIRATION))
-	if err != nil {
+
+	// Failures are only reset once the second factor is entered as well, as guessing it is also locked out.
+	if userInfo.MfaEnabled {
+		return nil, mfaRequired(&authToken)
+	}
+	if err := resetLoginFailures(authToken.UserId); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to reset failures")
+	}
+	if err := recordLogin(h.UserStore, authToken.UserId, now); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to record login")
+	}
+
+	if err := issueAccessToken(ctx, &authToken, now, USER_TOKEN_EXPIRATION); err != nil {
 		return nil, err
 	}
 
@@ -74,8 +150,14 @@ func (h *UserPasswordGrantTypeHandler) createAuthToken(ctx context.Context, r *C
 	if err != nil {
 		return nil, err
 	}
+	authToken.RefreshExpirationTime, err = ptypes.TimestampProto(now.Add(REFRESH_TOKEN_EXPIRATION))
+	if err != nil {
+		return nil, err
+	}
 
-	addAuthToken(authToken)
+	if err := addAuthToken(authToken); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store token")
+	}
 
 	return &authToken, nil
 }
@@ -102,19 +184,5 @@ func (h *UserPasswordGrantTypeHandler) CreateToken(ctx context.Context, r *Creat
 		return nil, err
 	}
 
-	resp := CreateTokenResponse{TokenType: "bearer", AccessToken: authToken.Access}
-
-	var scopeNames []string
-	for _, scope := range authToken.Scope {
-		scopeNames = append(scopeNames, Scope_name[int32(scope)])
-	}
-	resp.Scope = strings.Join(scopeNames, " ")
-
-	t, err := ptypes.Timestamp(authToken.AccessExpirationTime)
-	if err != nil {
-		return nil, err
-	}
-	resp.ExpiresIn = int32(math.Ceil(t.Sub(time.Now()).Seconds()))
-
-	return &resp, nil
+	return createTokenResponse(authToken)
 }
@@ -1,36 +1,147 @@
 package config
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"github.com/go-pg/pg"
 	"go.uber.org/zap"
 	"os"
+	"strconv"
+	"time"
 )
 
 var (
-	Db         = connect()
-	Logger, _  = zap.NewDevelopment()
-	PrivateKey = generateKey()
-	Sugar      = Logger.Sugar()
+	Db          = connect()
+	Logger, _   = zap.NewDevelopment()
+	Sugar       = Logger.Sugar()
+	TokenStore  = getenv("TOKEN_STORE", "postgres")  // Either "postgres" or "memory"
+	TokenFormat = getenv("TOKEN_FORMAT", "opaque")   // Either "opaque" or "jwt"
+	TicketStore = getenv("TICKET_STORE", "postgres") // Either "postgres" or "memory"
+	KeyStore    = getenv("KEY_STORE", "postgres")    // Either "postgres", "file" or "memory"
+	KeyDir      = getenv("KEY_DIR", "keys")          // Directory of PEM files, if KEY_STORE is "file"
+
+	// The client that is created when the server starts for the first time
+	DefaultClientId     = getenv("DEFAULT_CLIENT_ID", "client")
+	DefaultClientSecret = getenv("DEFAULT_CLIENT_SECRET", "password")
+
+	// The client that administers other clients, which is only created if a secret is given
+	AdminClientId     = getenv("ADMIN_CLIENT_ID", "admin")
+	AdminClientSecret = os.Getenv("ADMIN_CLIENT_SECRET")
+
+	// A space-separated list of scopes that dynamically registered clients may request
+	RegistrationScopes = getenv("REGISTRATION_SCOPES", "user_creation user_authorize")
+
+	// The issuer of ID tokens, which is the external URL of the Rest API
+	Issuer = getenv("ISSUER", "http://localhost:8080")
+
+	// The URL of the token endpoint, which JWT client assertions must name as their audience
+	TokenEndpoint = getenv("TOKEN_ENDPOINT", Issuer+"/oauth/tokens")
+
+	// The page where users enter the user codes shown by devices, which this server does not serve. Device authorization
+	// is disabled unless it is set.
+	DeviceVerificationUri = os.Getenv("DEVICE_VERIFICATION_URI")
+
+	// TLS is enabled for both the gRPC and the REST listeners if a certificate is given. Clients may then also authenticate
+	// with certificates issued by the client CA, if one is given, with their client id as the common name.
+	TLSCertFile     = os.Getenv("TLS_CERT_FILE")
+	TLSKeyFile      = os.Getenv("TLS_KEY_FILE")
+	TLSClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+
+	// Where users are looked up, either "postgres", "ldap", or "ldap,postgres" to fall back to Postgres for users that are
+	// not in the directory
+	UserStore = getenv("USER_STORE", "postgres")
+
+	// The LDAP directory, if USER_STORE includes "ldap". LdapGroupScopes maps the common names of groups to scopes, e.g.,
+	// "admins=user_profile client_admin;developers=user_profile".
+	LdapAddress        = getenv("LDAP_ADDRESS", "127.0.0.1:389")
+	LdapUseTLS         = os.Getenv("LDAP_USE_TLS") == "true"
+	LdapBindDN         = os.Getenv("LDAP_BIND_DN")
+	LdapBindPassword   = os.Getenv("LDAP_BIND_PASSWORD")
+	LdapBaseDN         = os.Getenv("LDAP_BASE_DN")
+	LdapUserFilter     = getenv("LDAP_USER_FILTER", "(uid=%s)")
+	LdapGroupAttribute = getenv("LDAP_GROUP_ATTRIBUTE", "memberOf")
+	LdapGroupScopes    = os.Getenv("LDAP_GROUP_SCOPES")
+
+	// The upstream OpenID provider whose ID tokens users may log in with. Its JWKS is loaded from FederatedJwks, which is
+	// either a URL or the path of a file. Federated login is disabled unless an issuer is given.
+	FederatedIssuer   = os.Getenv("FEDERATED_ISSUER")
+	FederatedAudience = os.Getenv("FEDERATED_AUDIENCE")
+	FederatedJwks     = os.Getenv("FEDERATED_JWKS")
+
+	// The issuer that authenticator apps show next to the accounts of users who enroll in TOTP
+	TotpIssuer = getenv("TOTP_ISSUER", "postgres-grpc-example")
+
+	// Once a username or a client address has failed to log in as many times as its threshold, further attempts are
+	// refused for LockoutBaseDelay, doubling with each failure up to LockoutMaxDelay. Failures are forgotten after
+	// LockoutWindow without any.
+	LockoutUserThreshold    = getenvInt("LOCKOUT_USER_THRESHOLD", 5)
+	LockoutAddressThreshold = getenvInt("LOCKOUT_ADDRESS_THRESHOLD", 20)
+	LockoutBaseDelay        = getenvDuration("LOCKOUT_BASE_DELAY", time.Second)
+	LockoutMaxDelay         = getenvDuration("LOCKOUT_MAX_DELAY", time.Minute*15)
+	LockoutWindow           = getenvDuration("LOCKOUT_WINDOW", time.Hour)
+
+	// Where messages to users, such as password reset tokens, are delivered, either "mail" to their emails, or "log" or
+	// "file" during development, which reveal the tokens to whoever reads them
+	Notifier     = getenv("NOTIFIER", "mail")
+	NotifierFile = getenv("NOTIFIER_FILE", "notifications.txt")
+
+	// The page where users enter new passwords, which receives the reset token as the token parameter
+	PasswordResetUri = getenv("PASSWORD_RESET_URI", Issuer+"/reset-password")
+
+	// How emails, such as verification tokens and mail notifications, are sent, either "smtp", or "file" or "memory" during
+	// development, which reveal the tokens to whoever reads them
+	Mailer       = getenv("MAILER", "smtp")
+	MailerFile   = getenv("MAILER_FILE", "mail.txt")
+	MailFrom     = getenv("MAIL_FROM", "noreply@localhost")
+	SmtpAddress  = getenv("SMTP_ADDRESS", "127.0.0.1:25")
+	SmtpUsername = os.Getenv("SMTP_USERNAME")
+	SmtpPassword = os.Getenv("SMTP_PASSWORD")
+
+	// The page where users verify their emails, which receives the verification token as the token parameter
+	EmailVerificationUri = getenv("EMAIL_VERIFICATION_URI", Issuer+"/verify-email")
+
+	// Whether the server applies pending schema migrations when it starts, or refuses to start until they are applied with
+	// "pg_server migrate up"
+	MigrateOnStart = getenv("MIGRATE_ON_START", "true") == "true"
+
+	TokenPurgeInterval  = getenvDuration("TOKEN_PURGE_INTERVAL", time.Minute*10)
+	KeyRotationInterval = getenvDuration("KEY_ROTATION_INTERVAL", time.Hour*24*30)
 )
 
-func generateKey() *rsa.PrivateKey {
-	if key, err := rsa.GenerateKey(rand.Reader, 1024); err != nil {
-		Logger.Fatal("Unable to generate RSA key", zap.Error(err))
-		return nil
+func getenv(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getenvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if d, err := time.ParseDuration(value); err != nil {
+		Logger.Fatal("Invalid duration", zap.String("key", key), zap.Error(err))
+		return defaultValue
 	} else {
-		return key
+		return d
 	}
 }
 
-func connect() *pg.DB {
-	var addr = os.Getenv("POSTGRESQL_ADDRESS")
-	if addr == "" {
-		addr = "127.0.0.1:5432"
+func getenvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if i, err := strconv.Atoi(value); err != nil {
+		Logger.Fatal("Invalid integer", zap.String("key", key), zap.Error(err))
+		return defaultValue
+	} else {
+		return i
 	}
+}
+
+func connect() *pg.DB {
 	return pg.Connect(&pg.Options{
-		Addr:     addr,
+		Addr:     getenv("POSTGRESQL_ADDRESS", "127.0.0.1:5432"),
 		User:     "postgres",
 		Password: "password",
 	})
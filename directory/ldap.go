@@ -0,0 +1,155 @@
+package directory
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"gopkg.in/ldap.v2"
+	"strings"
+)
+
+// LdapUserStore authenticates users by binding to an LDAP directory with their own credentials. The scope of a user is
+// DefaultScope, plus the scopes of the groups in the user's GroupAttribute (such as memberOf), keyed by the common name
+// of the group.
+type LdapUserStore struct {
+	Addr   string
+	UseTLS bool
+
+	// The service account that searches for users, or empty for anonymous searches
+	BindDN       string
+	BindPassword string
+
+	BaseDN         string
+	UserFilter     string // With %s for the escaped username, e.g., (uid=%s)
+	GroupAttribute string
+	GroupScopes    map[string][]auth.Scope
+	DefaultScope   []auth.Scope
+}
+
+// ParseGroupScopes parses group scopes in the form "admins=user_profile user_admin;developers=user_profile".
+func ParseGroupScopes(s string) (map[string][]auth.Scope, error) {
+	groupScopes := make(map[string][]auth.Scope)
+	for _, group := range strings.Split(s, ";") {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+		parts := strings.SplitN(group, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid group scopes " + group)
+		}
+		scope, err := auth.ParseScope(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		groupScopes[strings.TrimSpace(parts[0])] = scope
+	}
+	return groupScopes, nil
+}
+
+func (s *LdapUserStore) connect() (*ldap.Conn, error) {
+	var conn *ldap.Conn
+	var err error
+	if s.UseTLS {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		conn, err = ldap.DialTLS("tcp", s.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = ldap.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.BindDN != "" {
+		if err := conn.Bind(s.BindDN, s.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *LdapUserStore) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(
+		s.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(s.UserFilter, ldap.EscapeFilter(username)),
+		[]string{s.GroupAttribute},
+		nil)
+	// An ambiguous filter must not let a user log in as someone else, nor as a user of another store.
+	result, err := conn.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, auth.ErrAmbiguousUser
+	} else if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, auth.ErrUserNotFound
+	} else if len(result.Entries) > 1 {
+		return nil, auth.ErrAmbiguousUser
+	}
+	return result.Entries[0], nil
+}
+
+func (s *LdapUserStore) userInfo(entry *ldap.Entry) *auth.UserInfo {
+	scope := append([]auth.Scope{}, s.DefaultScope...)
+	for _, group := range entry.GetAttributeValues(s.GroupAttribute) {
+		dn, err := ldap.ParseDN(group)
+		if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+			continue
+		}
+		for _, g := range s.GroupScopes[dn.RDNs[0].Attributes[0].Value] {
+			if !containsScope(scope, g) {
+				scope = append(scope, g)
+			}
+		}
+	}
+	return &auth.UserInfo{Scope: scope}
+}
+
+func containsScope(scopes []auth.Scope, scope auth.Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *LdapUserStore) GetUserInfo(username string) (*auth.UserInfo, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := s.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.userInfo(entry), nil
+}
+
+func (s *LdapUserStore) Authenticate(username string, password string) (*auth.UserInfo, error) {
+	// Most directories accept a bind with an empty password as an anonymous one.
+	if password == "" {
+		return nil, auth.ErrIncorrectPassword
+	}
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := s.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	// The groups are read before binding as the user, who may not be allowed to read them.
+	userInfo := s.userInfo(entry)
+	if err := conn.Bind(entry.DN, password); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, auth.ErrIncorrectPassword
+	} else if err != nil {
+		return nil, err
+	}
+	return userInfo, nil
+}
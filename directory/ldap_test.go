@@ -0,0 +1,262 @@
+package directory
+
+import (
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testBaseDN       = "dc=example,dc=com"
+	testBindDN       = "cn=search,dc=example,dc=com"
+	testBindPassword = "search password"
+)
+
+type testEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// standInDirectory is an in-process LDAP server that knows just enough of the protocol for LdapUserStore, i.e., simple
+// binds, and searches with equality filters. Like real directories, it stops a search with sizeLimitExceeded once more
+// entries match than were asked for.
+type standInDirectory struct {
+	listener net.Listener
+	entries  []testEntry
+}
+
+func newStandInDirectory(t *testing.T, entries ...testEntry) *standInDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &standInDirectory{listener, entries}
+	go d.serve()
+	return d
+}
+
+func (d *standInDirectory) Close() {
+	d.listener.Close()
+}
+
+func (d *standInDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.serveConn(conn)
+	}
+}
+
+func (d *standInDirectory) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = append(responses, ldapResult(ldap.ApplicationBindResponse, d.bind(op)))
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(op)
+		default:
+			return
+		}
+		for _, response := range responses {
+			envelope := ber.NewSequence("LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "MessageID"))
+			envelope.AppendChild(response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *standInDirectory) bind(op *ber.Packet) int {
+	dn := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	if dn == testBindDN && password == testBindPassword {
+		return ldap.LDAPResultSuccess
+	}
+	for _, entry := range d.entries {
+		if entry.dn == dn && entry.password != "" && entry.password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (d *standInDirectory) search(op *ber.Packet) []*ber.Packet {
+	sizeLimit := int(op.Children[3].Value.(int64))
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		return []*ber.Packet{ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+	// Only equality filters, such as (uid=alice), are supported.
+	parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")"), "=", 2)
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, a.Value.(string))
+	}
+
+	var responses []*ber.Packet
+	for _, entry := range d.entries {
+		if !containsValue(entry.attributes[parts[0]], parts[1]) {
+			continue
+		}
+		if sizeLimit > 0 && len(responses) == sizeLimit {
+			return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+		responses = append(responses, searchResultEntry(entry, attributes))
+	}
+	return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapResult(tag ber.Tag, resultCode int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+func searchResultEntry(entry testEntry, attributes []string) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "Object Name"))
+	list := ber.NewSequence("Attributes")
+	for _, name := range attributes {
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range entry.attributes[name] {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(values)
+		list.AppendChild(attribute)
+	}
+	result.AppendChild(list)
+	return result
+}
+
+func user(uid string, password string, groups ...string) testEntry {
+	return testEntry{
+		dn:         "uid=" + uid + ",ou=people," + testBaseDN,
+		password:   password,
+		attributes: map[string][]string{"uid": {uid}, "memberOf": groups},
+	}
+}
+
+func newTestStore(d *standInDirectory) *LdapUserStore {
+	return &LdapUserStore{
+		Addr:           d.listener.Addr().String(),
+		BindDN:         testBindDN,
+		BindPassword:   testBindPassword,
+		BaseDN:         testBaseDN,
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		GroupScopes: map[string][]auth.Scope{
+			"admins":     {auth.Scope_user_admin, auth.Scope_user_profile},
+			"developers": {auth.Scope_client_admin},
+		},
+		DefaultScope: []auth.Scope{auth.Scope_user_profile},
+	}
+}
+
+func TestLdapUserStore(t *testing.T) {
+	d := newStandInDirectory(t,
+		user("alice", "alice password", "cn=admins,ou=groups,"+testBaseDN, "cn=unknown,ou=groups,"+testBaseDN),
+		user("bob", "bob password"),
+		user("carol", "carol password"), user("carol", "other carol password"),
+		user("dave", "dave password"), user("dave", "dave password"), user("dave", "dave password"))
+	defer d.Close()
+	s := newTestStore(d)
+
+	tests := []struct {
+		username string
+		password string
+		scope    []auth.Scope
+		err      error
+	}{
+		{"alice", "alice password", []auth.Scope{auth.Scope_user_profile, auth.Scope_user_admin}, nil},
+		{"bob", "bob password", []auth.Scope{auth.Scope_user_profile}, nil},
+		{"bob", "alice password", nil, auth.ErrIncorrectPassword},
+		{"bob", "", nil, auth.ErrIncorrectPassword},
+		{"eve", "eve password", nil, auth.ErrUserNotFound},
+		{"carol", "carol password", nil, auth.ErrAmbiguousUser},
+		{"dave", "dave password", nil, auth.ErrAmbiguousUser},
+	}
+	for _, test := range tests {
+		userInfo, err := s.Authenticate(test.username, test.password)
+		if err != test.err {
+			t.Errorf("Authenticate(%s, %s): expected error %v, got %v", test.username, test.password, test.err, err)
+		} else if err == nil && !reflect.DeepEqual(userInfo.Scope, test.scope) {
+			t.Errorf("Authenticate(%s, %s): expected scope %v, got %v", test.username, test.password, test.scope, userInfo.Scope)
+		}
+		if test.err == auth.ErrIncorrectPassword {
+			continue
+		}
+		userInfo, err = s.GetUserInfo(test.username)
+		if err != test.err {
+			t.Errorf("GetUserInfo(%s): expected error %v, got %v", test.username, test.err, err)
+		} else if err == nil && !reflect.DeepEqual(userInfo.Scope, test.scope) {
+			t.Errorf("GetUserInfo(%s): expected scope %v, got %v", test.username, test.scope, userInfo.Scope)
+		}
+	}
+}
+
+func TestLdapUserStoreServiceAccount(t *testing.T) {
+	d := newStandInDirectory(t, user("alice", "alice password"))
+	defer d.Close()
+	s := newTestStore(d)
+	s.BindPassword = "incorrect"
+	if _, err := s.GetUserInfo("alice"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestParseGroupScopes(t *testing.T) {
+	tests := []struct {
+		s           string
+		groupScopes map[string][]auth.Scope
+		valid       bool
+	}{
+		{"", map[string][]auth.Scope{}, true},
+		{"admins=user_profile user_admin", map[string][]auth.Scope{"admins": {auth.Scope_user_profile, auth.Scope_user_admin}}, true},
+		{" admins = user_admin ;developers=client_admin;", map[string][]auth.Scope{"admins": {auth.Scope_user_admin}, "developers": {auth.Scope_client_admin}}, true},
+		{"admins=", map[string][]auth.Scope{"admins": nil}, true},
+		{"admins", nil, false},
+		{"admins=user_profile unknown", nil, false},
+	}
+	for _, test := range tests {
+		groupScopes, err := ParseGroupScopes(test.s)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("ParseGroupScopes(%q): expected error", test.s)
+			}
+		} else if err != nil {
+			t.Errorf("ParseGroupScopes(%q): %v", test.s, err)
+		} else if !reflect.DeepEqual(groupScopes, test.groupScopes) {
+			t.Errorf("ParseGroupScopes(%q): expected %v, got %v", test.s, test.groupScopes, groupScopes)
+		}
+	}
+}
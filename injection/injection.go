@@ -1,31 +1,128 @@
 package injection
 
 import (
-	"fmt"
 	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"github.com/tfeng/postgres-grpc-example/directory"
+	"github.com/tfeng/postgres-grpc-example/mail"
+	"github.com/tfeng/postgres-grpc-example/models/client"
+	"github.com/tfeng/postgres-grpc-example/models/key"
+	"github.com/tfeng/postgres-grpc-example/models/ticket"
+	"github.com/tfeng/postgres-grpc-example/models/token"
 	"github.com/tfeng/postgres-grpc-example/models/user"
+	"github.com/tfeng/postgres-grpc-example/notify"
+	"strings"
 )
 
 var (
+	ClientStore       = &client.ClientStore{}
 	GrantTypeHandlers = grantTypeHandlers
+	TokenStore        = tokenStore()
+	KeyStore          = keyStore()
+	TicketStore       = ticketStore()
+	UserStore         = userStore()
+	Mailer            = mailer()
+	UserService       = &user.UserService{Mailer: Mailer, Notifier: notifier(), TicketStore: TicketStore}
 )
 
-var grantTypeHandlers = map[string]auth.GrantTypeHandler{
-	auth.GrantType_client_credentials.String(): &auth.ClientCredentialsGrantTypeHandler{&clientStore{}},
-	auth.GrantType_password.String():           &auth.UserPasswordGrantTypeHandler{&user.UserStore{}},
+func tokenStore() auth.TokenStore {
+	if config.TokenStore == "memory" {
+		return auth.NewMemoryTokenStore()
+	}
+	return &token.TokenStore{}
+}
+
+func userStore() auth.ChainUserStore {
+	var stores auth.ChainUserStore
+	for _, name := range strings.Split(config.UserStore, ",") {
+		switch strings.TrimSpace(name) {
+		case "ldap":
+			stores = append(stores, ldapUserStore())
+		case "postgres":
+			stores = append(stores, &user.UserStore{})
+		default:
+			config.Logger.Fatal("Unknown user store " + name)
+		}
+	}
+	return stores
+}
+
+func ldapUserStore() *directory.LdapUserStore {
+	groupScopes, err := directory.ParseGroupScopes(config.LdapGroupScopes)
+	if err != nil {
+		config.Logger.Fatal("Invalid LDAP group scopes " + config.LdapGroupScopes)
+	}
+	return &directory.LdapUserStore{
+		Addr:           config.LdapAddress,
+		UseTLS:         config.LdapUseTLS,
+		BindDN:         config.LdapBindDN,
+		BindPassword:   config.LdapBindPassword,
+		BaseDN:         config.LdapBaseDN,
+		UserFilter:     config.LdapUserFilter,
+		GroupAttribute: config.LdapGroupAttribute,
+		GroupScopes:    groupScopes,
+		DefaultScope:   []auth.Scope{auth.Scope_user_profile},
+	}
 }
 
-type clientStore struct{}
+func mailer() mail.Mailer {
+	switch config.Mailer {
+	case "smtp":
+		return &mail.SmtpMailer{
+			Addr:     config.SmtpAddress,
+			Username: config.SmtpUsername,
+			Password: config.SmtpPassword,
+			From:     config.MailFrom,
+		}
+	case "file":
+		return &mail.FileMailer{Path: config.MailerFile, From: config.MailFrom}
+	case "memory":
+		return &mail.MemoryMailer{}
+	default:
+		config.Logger.Fatal("Unknown mailer " + config.Mailer)
+		return nil
+	}
+}
 
-var clients = map[string]auth.ClientInfo{
-	"client": {"password", []auth.Scope{auth.Scope_user_creation, auth.Scope_user_authorize}},
+func notifier() notify.Notifier {
+	switch config.Notifier {
+	case "mail":
+		return &notify.MailNotifier{Mailer: Mailer, Emails: (&user.UserStore{}).GetEmail}
+	case "log":
+		return &notify.LogNotifier{Logger: config.Logger}
+	case "file":
+		return &notify.FileNotifier{Path: config.NotifierFile}
+	default:
+		config.Logger.Fatal("Unknown notifier " + config.Notifier)
+		return nil
+	}
 }
 
-func (h *clientStore) GetClientInfo(clientId string) (*auth.ClientInfo, error) {
-	clientInfo, ok := clients[clientId]
-	if ok {
-		return &clientInfo, nil
-	} else {
-		return nil, fmt.Errorf("Client not found")
+func ticketStore() auth.TicketStore {
+	if config.TicketStore == "memory" {
+		return auth.NewMemoryTicketStore()
 	}
+	return &ticket.TicketStore{}
+}
+
+func keyStore() auth.KeyStore {
+	switch config.KeyStore {
+	case "file":
+		return &auth.FileKeyStore{config.KeyDir}
+	case "memory":
+		return &auth.MemoryKeyStore{}
+	default:
+		return &key.KeyStore{}
+	}
+}
+
+var grantTypeHandlers = map[string]auth.GrantTypeHandler{
+	auth.GrantType_client_credentials.String(): &auth.ClientCredentialsGrantTypeHandler{ClientStore, config.TokenEndpoint},
+	auth.GrantType_password.String():           &auth.UserPasswordGrantTypeHandler{UserStore},
+	auth.GrantType_refresh_token.String():      &auth.RefreshTokenGrantTypeHandler{UserStore},
+	auth.GrantType_authorization_code.String(): &auth.AuthorizationCodeGrantTypeHandler{ClientStore, UserStore},
+	auth.GRANT_TYPE_DEVICE_CODE:                &auth.DeviceCodeGrantTypeHandler{ClientStore, UserStore},
+	auth.GRANT_TYPE_TOKEN_EXCHANGE:             &auth.TokenExchangeGrantTypeHandler{},
+	auth.GRANT_TYPE_JWT_BEARER:                 &auth.JwtBearerGrantTypeHandler{&user.UserStore{}},
+	auth.GrantType_mfa.String():                &auth.MfaGrantTypeHandler{&user.UserStore{}},
 }
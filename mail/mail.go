@@ -0,0 +1,101 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends emails to addresses.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// Message is an email as sent by a Mailer.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func format(from string, message *Message) []byte {
+	var b bytes.Buffer
+	if from != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.Replace(message.Body, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// SmtpMailer sends emails through an SMTP server, authenticating with PLAIN if a username is given. The standard library
+// upgrades the connection with STARTTLS if the server supports it, and refuses to send credentials without TLS unless the
+// server is on localhost.
+type SmtpMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SmtpMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, format(m.From, &Message{to, subject, body}))
+}
+
+// MemoryMailer keeps emails in memory instead of sending them, for tests.
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(to string, subject string, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, Message{to, subject, body})
+	return nil
+}
+
+// Messages returns the emails sent so far, in order.
+func (m *MemoryMailer) Messages() []Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// FileMailer appends emails to a local file instead of sending them, which stands in for an SMTP server during
+// development.
+type FileMailer struct {
+	Path string
+	From string
+
+	mutex sync.Mutex
+}
+
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(format(m.From, &Message{to, subject, body}), "\r\n"...))
+	return err
+}
@@ -0,0 +1,200 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"time"
+)
+
+// LOCK_KEY identifies the advisory lock that serializes migrations, so that replicas starting at the same time do not
+// apply the same migration twice.
+const LOCK_KEY = 0x6d6967726174
+
+var ErrNothingToRevert = errors.New("No migration to revert")
+
+// Migration changes the schema from the previous version to Version. Up and Down run in a transaction, which also
+// records the version in the schema_migrations table.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *pg.Tx) error
+	Down    func(tx *pg.Tx) error
+}
+
+// SchemaMigration is the row of an applied migration.
+type SchemaMigration struct {
+	tableName struct{} `sql:"schema_migrations,alias:schema_migration"`
+
+	Version   int `sql:",pk"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Status is a migration, and when it was applied, if it was.
+type Status struct {
+	Migration *Migration
+	AppliedAt *time.Time
+}
+
+// sqlMigration returns a migration that executes statements, which must not contain ? since go-pg would take it for a
+// parameter.
+func sqlMigration(version int, name string, up string, down string) Migration {
+	return Migration{
+		Version: version,
+		Name:    name,
+		Up: func(tx *pg.Tx) error {
+			_, err := tx.Exec(up)
+			return err
+		},
+		Down: func(tx *pg.Tx) error {
+			_, err := tx.Exec(down)
+			return err
+		},
+	}
+}
+
+// lock takes the advisory lock until the end of the transaction, and creates the schema_migrations table if there is
+// none yet.
+func lock(tx *pg.Tx) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", LOCK_KEY); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`)
+	return err
+}
+
+// undefinedTable returns whether the error is that of a query on a table that does not exist.
+func undefinedTable(err error) bool {
+	pgErr, ok := err.(pg.Error)
+	return ok && pgErr.Field('C') == "42P01"
+}
+
+// applied returns the versions of the applied migrations. None have been applied if there is no schema_migrations table
+// yet.
+func applied(db orm.DB) (map[int]time.Time, error) {
+	var ms []SchemaMigration
+	if err := db.Model(&ms).Select(); err != nil && err != pg.ErrNoRows && !undefinedTable(err) {
+		return nil, err
+	}
+	versions := make(map[int]time.Time)
+	for _, m := range ms {
+		versions[m.Version] = m.AppliedAt
+	}
+	return versions, nil
+}
+
+func find(version int) *Migration {
+	for i := range migrations {
+		if migrations[i].Version == version {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+// Up applies the pending migrations in order, each in its own transaction, and returns those that it applied. Migrations
+// that another replica applied in the meantime are skipped.
+func Up(db *pg.DB) ([]*Migration, error) {
+	var done []*Migration
+	for i := range migrations {
+		m := &migrations[i]
+		ran := false
+		err := db.RunInTransaction(func(tx *pg.Tx) error {
+			if err := lock(tx); err != nil {
+				return err
+			}
+			versions, err := applied(tx)
+			if err != nil {
+				return err
+			}
+			if _, ok := versions[m.Version]; ok {
+				return nil
+			}
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			ran = true
+			return tx.Insert(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()})
+		})
+		if err != nil {
+			return done, fmt.Errorf("Migration %d %s failed: %v", m.Version, m.Name, err)
+		}
+		if ran {
+			done = append(done, m)
+		}
+	}
+	return done, nil
+}
+
+// Down reverts the latest applied migration.
+func Down(db *pg.DB) (*Migration, error) {
+	var reverted *Migration
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := lock(tx); err != nil {
+			return err
+		}
+		var latest SchemaMigration
+		if err := tx.Model(&latest).Order("version DESC").Limit(1).Select(); err == pg.ErrNoRows {
+			return ErrNothingToRevert
+		} else if err != nil {
+			return err
+		}
+		m := find(latest.Version)
+		if m == nil {
+			return fmt.Errorf("Migration %d %s is unknown to this version", latest.Version, latest.Name)
+		}
+		if err := m.Down(tx); err != nil {
+			return err
+		}
+		if _, err := tx.Model(&latest).Where("version = ?", latest.Version).Delete(); err != nil {
+			return err
+		}
+		reverted = m
+		return nil
+	})
+	return reverted, err
+}
+
+// statuses pairs all migrations, in order, with the times at which they were applied.
+func statuses(versions map[int]time.Time) []Status {
+	var statuses []Status
+	for i := range migrations {
+		s := Status{Migration: &migrations[i]}
+		if t, ok := versions[migrations[i].Version]; ok {
+			s.AppliedAt = &t
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// GetStatus returns all migrations in order, with the times at which they were applied. It neither takes the lock nor
+// creates the schema_migrations table, so that it can be used by replicas that are not allowed to migrate, and does not
+// wait for migrations in progress.
+func GetStatus(db *pg.DB) ([]Status, error) {
+	versions, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	return statuses(versions), nil
+}
+
+// Pending returns whether any migration has not been applied yet.
+func Pending(db *pg.DB) (bool, error) {
+	statuses, err := GetStatus(db)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
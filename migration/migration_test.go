@@ -0,0 +1,165 @@
+package migration
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TEST_SCHEMA is where the tests apply migrations, so that they start from an empty database without touching the
+// tables of other tests.
+const TEST_SCHEMA = "migration_test"
+
+func TestMigrationsOrdered(t *testing.T) {
+	names := make(map[string]bool)
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %s: expected version %d, got %d", m.Name, i+1, m.Version)
+		}
+		if m.Name == "" || names[m.Name] {
+			t.Errorf("migration %d: name %q empty or duplicate", m.Version, m.Name)
+		}
+		names[m.Name] = true
+		if m.Up == nil || m.Down == nil {
+			t.Errorf("migration %d %s: Up and Down required", m.Version, m.Name)
+		}
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	appliedAt := time.Unix(1500000000, 0)
+	s := statuses(map[int]time.Time{1: appliedAt})
+	if len(s) != len(migrations) {
+		t.Fatalf("expected %d statuses, got %d", len(migrations), len(s))
+	}
+	for i := range s {
+		if s[i].Migration != &migrations[i] {
+			t.Errorf("status %d: unexpected migration %d", i, s[i].Migration.Version)
+		}
+	}
+	if s[0].AppliedAt == nil || !s[0].AppliedAt.Equal(appliedAt) {
+		t.Errorf("migration 1: expected applied at %v, got %v", appliedAt, s[0].AppliedAt)
+	}
+	for _, status := range s[1:] {
+		if status.AppliedAt != nil {
+			t.Errorf("migration %d: expected pending", status.Migration.Version)
+		}
+	}
+}
+
+// testDB skips tests that need Postgres unless POSTGRESQL_ADDRESS points at a server, and connects to an empty
+// TEST_SCHEMA there.
+func testDB(t *testing.T) *pg.DB {
+	if os.Getenv("POSTGRESQL_ADDRESS") == "" {
+		t.Skip("POSTGRESQL_ADDRESS not set")
+	}
+	if _, err := config.Db.Exec("DROP SCHEMA IF EXISTS " + TEST_SCHEMA + " CASCADE; CREATE SCHEMA " + TEST_SCHEMA); err != nil {
+		t.Fatal(err)
+	}
+	options := *config.Db.Options()
+	options.OnConnect = func(conn *pg.DB) error {
+		_, err := conn.Exec("SET search_path TO " + TEST_SCHEMA)
+		return err
+	}
+	return pg.Connect(&options)
+}
+
+func pending(t *testing.T, db *pg.DB) []int {
+	s, err := GetStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []int
+	for _, status := range s {
+		if status.AppliedAt == nil {
+			versions = append(versions, status.Migration.Version)
+		}
+	}
+	return versions
+}
+
+func TestUpAndDown(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+
+	// Without a schema_migrations table, nothing has been applied.
+	if versions := pending(t, db); len(versions) != len(migrations) {
+		t.Errorf("expected all migrations pending, got %v", versions)
+	}
+	if p, err := Pending(db); err != nil || !p {
+		t.Errorf("expected pending migrations, got %v, %v", p, err)
+	}
+
+	if done, err := Up(db); err != nil {
+		t.Fatal(err)
+	} else if len(done) != len(migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(migrations), len(done))
+	}
+	if versions := pending(t, db); len(versions) != 0 {
+		t.Errorf("expected no migrations pending, got %v", versions)
+	}
+	if done, err := Up(db); err != nil || len(done) != 0 {
+		t.Errorf("expected nothing to apply, got %d, %v", len(done), err)
+	}
+
+	latest := &migrations[len(migrations)-1]
+	if m, err := Down(db); err != nil {
+		t.Fatal(err)
+	} else if m != latest {
+		t.Errorf("expected migration %d reverted, got %d", latest.Version, m.Version)
+	}
+	if versions := pending(t, db); len(versions) != 1 || versions[0] != latest.Version {
+		t.Errorf("expected migration %d pending, got %v", latest.Version, versions)
+	}
+	if done, err := Up(db); err != nil {
+		t.Fatal(err)
+	} else if len(done) != 1 || done[0] != latest {
+		t.Errorf("expected migration %d applied again, got %d migrations", latest.Version, len(done))
+	}
+
+	for range migrations {
+		if _, err := Down(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Down(db); err != ErrNothingToRevert {
+		t.Errorf("expected %v, got %v", ErrNothingToRevert, err)
+	}
+}
+
+func TestUpConcurrently(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+
+	const n = 5
+	var wg sync.WaitGroup
+	counts := make([]int, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done, err := Up(db)
+			counts[i], errs[i] = len(done), err
+		}(i)
+	}
+	wg.Wait()
+
+	// Each migration is applied by exactly one of the replicas.
+	total := 0
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		total += counts[i]
+	}
+	if total != len(migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(migrations), total)
+	}
+	if versions := pending(t, db); len(versions) != 0 {
+		t.Errorf("expected no migrations pending, got %v", versions)
+	}
+}
@@ -0,0 +1,157 @@
+package migration
+
+import (
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/golang/protobuf/proto"
+	"github.com/tfeng/postgres-grpc-example/auth"
+)
+
+// migrations are applied in the order of their versions, which must never change once released. Tables that earlier
+// versions created on startup are adopted as they are, and brought up to date.
+var migrations = []Migration{
+	sqlMigration(1, "create_users", `
+		CREATE TABLE IF NOT EXISTS users (
+			id text PRIMARY KEY,
+			hashed_password text,
+			totp_secret text,
+			totp_enabled boolean,
+			recovery_codes jsonb,
+			created_at bigint,
+			deleted_at bigint,
+			email text,
+			display_name text,
+			updated_at bigint,
+			last_login_at bigint,
+			status integer
+		);
+		ALTER TABLE users
+			ADD COLUMN IF NOT EXISTS totp_secret text,
+			ADD COLUMN IF NOT EXISTS totp_enabled boolean,
+			ADD COLUMN IF NOT EXISTS recovery_codes jsonb,
+			ADD COLUMN IF NOT EXISTS created_at bigint,
+			ADD COLUMN IF NOT EXISTS deleted_at bigint,
+			ADD COLUMN IF NOT EXISTS email text,
+			ADD COLUMN IF NOT EXISTS display_name text,
+			ADD COLUMN IF NOT EXISTS updated_at bigint,
+			ADD COLUMN IF NOT EXISTS last_login_at bigint,
+			ADD COLUMN IF NOT EXISTS status integer;
+		CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (lower(email)) WHERE email IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at, id);
+	`, `
+		DROP TABLE IF EXISTS users;
+	`),
+
+	sqlMigration(2, "create_federated_identities", `
+		CREATE TABLE IF NOT EXISTS federated_identities (
+			issuer text,
+			subject text,
+			user_id text REFERENCES users (id) ON DELETE CASCADE,
+			PRIMARY KEY (issuer, subject)
+		);
+	`, `
+		DROP TABLE IF EXISTS federated_identities;
+	`),
+
+	sqlMigration(3, "create_auth_tokens", `
+		CREATE TABLE IF NOT EXISTS auth_tokens (
+			access text PRIMARY KEY,
+			refresh text UNIQUE,
+			user_id text,
+			expiration_time timestamptz,
+			data bytea
+		);
+		ALTER TABLE auth_tokens ADD COLUMN IF NOT EXISTS expiration_time timestamptz;
+		CREATE INDEX IF NOT EXISTS auth_tokens_user_id_idx ON auth_tokens (user_id);
+		CREATE INDEX IF NOT EXISTS auth_tokens_expiration_time_idx ON auth_tokens (expiration_time);
+	`, `
+		DROP TABLE IF EXISTS auth_tokens;
+	`),
+
+	sqlMigration(4, "create_tickets", `
+		CREATE TABLE IF NOT EXISTS tickets (
+			kind text,
+			key text,
+			value bytea,
+			expiration_time timestamptz,
+			PRIMARY KEY (kind, key)
+		);
+		CREATE INDEX IF NOT EXISTS tickets_expiration_time_idx ON tickets (expiration_time);
+	`, `
+		DROP TABLE IF EXISTS tickets;
+	`),
+
+	sqlMigration(5, "create_clients", `
+		CREATE TABLE IF NOT EXISTS clients (
+			id text PRIMARY KEY,
+			hashed_secret text,
+			scope jsonb,
+			disabled boolean,
+			name text,
+			grant_types jsonb,
+			redirect_uris jsonb,
+			public_key text
+		);
+		ALTER TABLE clients
+			ADD COLUMN IF NOT EXISTS disabled boolean,
+			ADD COLUMN IF NOT EXISTS name text,
+			ADD COLUMN IF NOT EXISTS grant_types jsonb,
+			ADD COLUMN IF NOT EXISTS redirect_uris jsonb,
+			ADD COLUMN IF NOT EXISTS public_key text;
+	`, `
+		DROP TABLE IF EXISTS clients;
+	`),
+
+	sqlMigration(6, "create_signing_keys", `
+		CREATE TABLE IF NOT EXISTS signing_keys (
+			id text PRIMARY KEY,
+			creation_time timestamptz,
+			private_key text
+		);
+	`, `
+		DROP TABLE IF EXISTS signing_keys;
+	`),
+
+	// Tokens are revoked by client as well, and the client ids of existing tokens are only found in their data.
+	{
+		Version: 7,
+		Name:    "add_auth_tokens_client_id",
+		Up: func(tx *pg.Tx) error {
+			if _, err := tx.Exec(`
+				ALTER TABLE auth_tokens ADD COLUMN IF NOT EXISTS client_id text;
+				CREATE INDEX IF NOT EXISTS auth_tokens_client_id_idx ON auth_tokens (client_id);
+			`); err != nil {
+				return err
+			}
+			var tokens []struct {
+				Access string
+				Data   []byte
+			}
+			if _, err := tx.Query(&tokens, "SELECT access, data FROM auth_tokens WHERE client_id IS NULL"); err != nil {
+				return err
+			}
+			for _, t := range tokens {
+				var authToken auth.AuthToken
+				if err := proto.Unmarshal(t.Data, &authToken); err != nil {
+					return err
+				}
+				if _, err := tx.Exec("UPDATE auth_tokens SET client_id = ? WHERE access = ?", authToken.ClientId, t.Access); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *pg.Tx) error {
+			_, err := tx.Exec("ALTER TABLE auth_tokens DROP COLUMN IF EXISTS client_id")
+			return err
+		},
+	},
+}
+
+func init() {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			panic(fmt.Sprintf("Migration %d is out of order", migrations[i].Version))
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	db = config.Db
+)
+
+func generateSecret() (string, error) {
+	b := make([]byte, 33)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) (string, error) {
+	hashedSecret, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	return string(hashedSecret), err
+}
+
+func validateScope(scope []auth.Scope) error {
+	for _, s := range scope {
+		if _, ok := auth.Scope_name[int32(s)]; !ok {
+			return status.Error(codes.InvalidArgument, "Unknown scope")
+		}
+	}
+	return nil
+}
+
+// EnsureClient creates the client unless a client with the same id already exists, in which case its secret and scope
+// are left alone.
+func EnsureClient(id string, secret string, scope []auth.Scope) error {
+	hashedSecret, err := hashSecret(secret)
+	if err != nil {
+		return err
+	}
+	c := Client{Id: id, HashedSecret: hashedSecret, Scope: scope}
+	_, err = db.Model(&c).OnConflict("DO NOTHING").Insert()
+	return err
+}
+
+type ClientStore struct{}
+
+func (s *ClientStore) GetClientInfo(clientId string) (*auth.ClientInfo, error) {
+	c := Client{Id: clientId}
+	if err := db.Select(&c); err == pg.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "Client not found")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch client")
+	} else if c.Disabled {
+		return nil, status.Error(codes.PermissionDenied, "Client disabled")
+	} else {
+		return &auth.ClientInfo{
+			HashedSecret: c.HashedSecret,
+			Scope:        c.Scope,
+			Name:         c.Name,
+			GrantTypes:   c.GrantTypes,
+			RedirectUris: c.RedirectUris,
+			PublicKey:    c.PublicKey,
+		}, nil
+	}
+}
+
+// CreateClient creates a public client if the secret is empty.
+func (s *ClientStore) CreateClient(clientId string, secret string, clientInfo *auth.ClientInfo) error {
+	var hashedSecret string
+	if secret != "" {
+		var err error
+		if hashedSecret, err = hashSecret(secret); err != nil {
+			return err
+		}
+	}
+	return db.Insert(&Client{
+		Id:           clientId,
+		HashedSecret: hashedSecret,
+		Scope:        clientInfo.Scope,
+		Name:         clientInfo.Name,
+		GrantTypes:   clientInfo.GrantTypes,
+		RedirectUris: clientInfo.RedirectUris,
+	})
+}
+
+type ClientService struct{}
+
+func getClient(id string) (*Client, error) {
+	c := Client{Id: id}
+	if err := db.Select(&c); err == pg.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "Client not found")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch client")
+	} else {
+		return &c, nil
+	}
+}
+
+func updateClient(c *Client, columns ...string) (*Client, error) {
+	if res, err := db.Model(c).Column(columns...).Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to update client")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "Client not found")
+	} else {
+		c.HashedSecret = ""
+		return c, nil
+	}
+}
+
+func (clientService *ClientService) Create(ctx context.Context, request *CreateRequest) (*ClientSecret, error) {
+	if err := validateScope(request.Scope); err != nil {
+		return nil, err
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate secret")
+	}
+	hashedSecret, err := hashSecret(secret)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate secret")
+	}
+
+	c := Client{Id: request.Id, HashedSecret: hashedSecret, Scope: request.Scope}
+	if res, err := db.Model(&c).OnConflict("DO NOTHING").Insert(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to create client")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.AlreadyExists, "Client already exists")
+	} else {
+		c.HashedSecret = ""
+		return &ClientSecret{&c, secret}, nil
+	}
+}
+
+func (clientService *ClientService) Get(ctx context.Context, request *GetRequest) (*Client, error) {
+	c, err := getClient(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	c.HashedSecret = ""
+	return c, nil
+}
+
+func (clientService *ClientService) List(ctx context.Context, request *ListRequest) (*ListResponse, error) {
+	var clients []*Client
+	if err := db.Model(&clients).Order("id").Select(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch clients")
+	}
+	for _, c := range clients {
+		c.HashedSecret = ""
+	}
+	return &ListResponse{clients}, nil
+}
+
+// RotateSecret replaces the secret of the client, and revokes the tokens issued with the old one, since the secret may
+// have leaked along with them.
+func (clientService *ClientService) RotateSecret(ctx context.Context, request *RotateSecretRequest) (*ClientSecret, error) {
+	c, err := getClient(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate secret")
+	}
+	if c.HashedSecret, err = hashSecret(secret); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate secret")
+	}
+	if c, err = updateClient(c, "hashed_secret"); err != nil {
+		return nil, err
+	}
+	if err := auth.RevokeClientTokens(c.Id); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to revoke tokens")
+	}
+	return &ClientSecret{c, secret}, nil
+}
+
+// removesScope returns whether any of the scopes is missing from the updated ones.
+func removesScope(scope []auth.Scope, updated []auth.Scope) bool {
+	for _, s := range scope {
+		found := false
+		for _, u := range updated {
+			if u == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateScope replaces the scopes of the client. If any scope is removed, the tokens issued to the client are revoked,
+// since they may still carry it.
+func (clientService *ClientService) UpdateScope(ctx context.Context, request *UpdateScopeRequest) (*Client, error) {
+	if err := validateScope(request.Scope); err != nil {
+		return nil, err
+	}
+	c, err := getClient(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	removed := removesScope(c.Scope, request.Scope)
+	c.Scope = request.Scope
+	if c, err = updateClient(c, "scope"); err != nil {
+		return nil, err
+	}
+	if removed {
+		if err := auth.RevokeClientTokens(c.Id); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to revoke tokens")
+		}
+	}
+	return c, nil
+}
+
+// SetPublicKey registers the key that the client's JWT assertions are verified with, so that it no longer needs to send
+// its secret to obtain tokens.
+func (clientService *ClientService) SetPublicKey(ctx context.Context, request *SetPublicKeyRequest) (*Client, error) {
+	if request.PublicKey != "" {
+		if _, err := auth.ParsePublicKey(request.PublicKey); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid public key")
+		}
+	}
+	c, err := getClient(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	c.PublicKey = request.PublicKey
+	return updateClient(c, "public_key")
+}
+
+// Disable prevents the client from obtaining new tokens and revokes its existing ones, while keeping its registration so
+// that it can be inspected.
+func (clientService *ClientService) Disable(ctx context.Context, request *DisableRequest) (*Client, error) {
+	c, err := getClient(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	c.Disabled = true
+	if c, err = updateClient(c, "disabled"); err != nil {
+		return nil, err
+	}
+	if err := auth.RevokeClientTokens(c.Id); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to revoke tokens")
+	}
+	return c, nil
+}
+
+func (clientService *ClientService) Delete(ctx context.Context, request *DeleteRequest) (*DeleteResponse, error) {
+	if res, err := db.Model(&Client{}).Where("id = ?", request.Id).Delete(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to delete client")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "Client not found")
+	} else if err := auth.RevokeClientTokens(request.Id); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to revoke tokens")
+	} else {
+		return &DeleteResponse{}, nil
+	}
+}
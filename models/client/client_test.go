@@ -0,0 +1,28 @@
+package client
+
+import (
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"testing"
+)
+
+func TestRemovesScope(t *testing.T) {
+	tests := []struct {
+		scope   []auth.Scope
+		updated []auth.Scope
+		removed bool
+	}{
+		{nil, nil, false},
+		{nil, []auth.Scope{auth.Scope_user_profile}, false},
+		{[]auth.Scope{auth.Scope_user_profile}, []auth.Scope{auth.Scope_user_profile}, false},
+		{[]auth.Scope{auth.Scope_user_profile}, []auth.Scope{auth.Scope_token_exchange, auth.Scope_user_profile}, false},
+		{[]auth.Scope{auth.Scope_user_profile, auth.Scope_token_exchange}, []auth.Scope{auth.Scope_token_exchange, auth.Scope_user_profile}, false},
+		{[]auth.Scope{auth.Scope_user_profile}, nil, true},
+		{[]auth.Scope{auth.Scope_user_profile}, []auth.Scope{auth.Scope_token_exchange}, true},
+		{[]auth.Scope{auth.Scope_user_profile, auth.Scope_token_exchange}, []auth.Scope{auth.Scope_user_profile}, true},
+	}
+	for _, test := range tests {
+		if removed := removesScope(test.scope, test.updated); removed != test.removed {
+			t.Errorf("removesScope(%v, %v): expected %v, got %v", test.scope, test.updated, test.removed, removed)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package key
+
+import (
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"time"
+)
+
+var (
+	db = config.Db
+)
+
+type Key struct {
+	tableName struct{} `sql:"signing_keys,alias:key"`
+
+	Id           string `sql:",pk"`
+	CreationTime time.Time
+	PrivateKey   string // PEM-encoded
+}
+
+type KeyStore struct{}
+
+func (s *KeyStore) List() ([]*auth.SigningKey, error) {
+	var ks []Key
+	if err := db.Model(&ks).Select(); err != nil {
+		return nil, err
+	}
+	var keys []*auth.SigningKey
+	for _, k := range ks {
+		key, err := auth.DecodeSigningKey([]byte(k.PrivateKey), k.CreationTime)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *KeyStore) Add(key *auth.SigningKey) error {
+	return db.Insert(&Key{Id: key.Id, CreationTime: key.CreationTime, PrivateKey: string(auth.EncodeSigningKey(key))})
+}
+
+func (s *KeyStore) Remove(id string) error {
+	res, err := db.Model(&Key{}).Where("id = ?", id).Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return auth.ErrKeyNotFound
+	}
+	return nil
+}
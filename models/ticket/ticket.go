@@ -0,0 +1,94 @@
+package ticket
+
+import (
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"time"
+)
+
+var (
+	db = config.Db
+)
+
+type Ticket struct {
+	tableName struct{} `sql:"tickets,alias:ticket"`
+
+	Kind           string `sql:",pk"`
+	Key            string `sql:",pk"`
+	Value          []byte
+	ExpirationTime time.Time
+}
+
+type TicketStore struct{}
+
+func (s *TicketStore) Put(kind string, key string, value []byte, expirationTime time.Time) error {
+	t := Ticket{Kind: kind, Key: key, Value: value, ExpirationTime: expirationTime}
+	_, err := db.Model(&t).
+		OnConflict("(kind, key) DO UPDATE").
+		Set("value = EXCLUDED.value, expiration_time = EXCLUDED.expiration_time").
+		Insert()
+	return err
+}
+
+func (s *TicketStore) Add(kind string, key string, value []byte, expirationTime time.Time) error {
+	t := Ticket{Kind: kind, Key: key, Value: value, ExpirationTime: expirationTime}
+	// Expired tickets may not have been purged yet, and are replaced.
+	res, err := db.Model(&t).
+		OnConflict("(kind, key) DO UPDATE").
+		Set("value = EXCLUDED.value, expiration_time = EXCLUDED.expiration_time").
+		Where("ticket.expiration_time <= ?", time.Now()).
+		Insert()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return auth.ErrTicketExists
+	}
+	return nil
+}
+
+func (s *TicketStore) Get(kind string, key string) ([]byte, error) {
+	var t Ticket
+	res, err := db.Query(&t, "SELECT * FROM tickets WHERE kind = ? AND key = ? AND expiration_time > ?", kind, key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsReturned() == 0 {
+		return nil, auth.ErrTicketNotFound
+	}
+	return t.Value, nil
+}
+
+func (s *TicketStore) Take(kind string, key string) ([]byte, error) {
+	var t Ticket
+	res, err := db.Model(&t).
+		Where("kind = ? AND key = ? AND expiration_time > ?", kind, key, time.Now()).
+		Returning("*").
+		Delete()
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, auth.ErrTicketNotFound
+	}
+	return t.Value, nil
+}
+
+func (s *TicketStore) Delete(kind string, key string) error {
+	res, err := db.Model(&Ticket{}).Where("kind = ? AND key = ?", kind, key).Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return auth.ErrTicketNotFound
+	}
+	return nil
+}
+
+func (s *TicketStore) PurgeExpired(now time.Time) (int, error) {
+	res, err := db.Model(&Ticket{}).Where("expiration_time <= ?", now).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
@@ -0,0 +1,126 @@
+package token
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/golang/protobuf/proto"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"time"
+)
+
+var (
+	db = config.Db
+)
+
+// Token is the row of an auth.AuthToken. The token itself is kept as serialized protobuf, and only the columns needed for
+// lookups are broken out.
+type Token struct {
+	tableName struct{} `sql:"auth_tokens,alias:token"`
+
+	Access         string `sql:",pk"`
+	Refresh        string `sql:",unique"`
+	UserId         string
+	ClientId       string
+	ExpirationTime time.Time
+	Data           []byte
+}
+
+func newToken(authToken *auth.AuthToken) (*Token, error) {
+	data, err := proto.Marshal(authToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Access:         authToken.Access,
+		Refresh:        authToken.Refresh,
+		UserId:         authToken.UserId,
+		ClientId:       authToken.ClientId,
+		ExpirationTime: authToken.ExpirationTime(),
+		Data:           data,
+	}, nil
+}
+
+func (t *Token) authToken() (*auth.AuthToken, error) {
+	var authToken auth.AuthToken
+	if err := proto.Unmarshal(t.Data, &authToken); err != nil {
+		return nil, err
+	}
+	return &authToken, nil
+}
+
+type TokenStore struct{}
+
+func (s *TokenStore) Add(authToken auth.AuthToken) error {
+	t, err := newToken(&authToken)
+	if err != nil {
+		return err
+	}
+	return db.Insert(t)
+}
+
+func (s *TokenStore) Get(access string) (*auth.AuthToken, error) {
+	t := Token{Access: access}
+	if err := db.Select(&t); err == pg.ErrNoRows {
+		return nil, auth.ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return t.authToken()
+}
+
+func (s *TokenStore) GetByRefresh(refresh string) (*auth.AuthToken, error) {
+	var t Token
+	if err := db.Model(&t).Where("refresh = ?", refresh).Select(); err == pg.ErrNoRows {
+		return nil, auth.ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return t.authToken()
+}
+
+func (s *TokenStore) Revoke(access string) error {
+	res, err := db.Model(&Token{}).Where("access = ?", access).Delete()
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return auth.ErrTokenNotFound
+	}
+	return nil
+}
+
+func (s *TokenStore) ListByUser(userId string) ([]*auth.AuthToken, error) {
+	var ts []Token
+	if err := db.Model(&ts).Where("user_id = ?", userId).Select(); err != nil {
+		return nil, err
+	}
+	return toAuthTokens(ts)
+}
+
+func (s *TokenStore) ListByClient(clientId string) ([]*auth.AuthToken, error) {
+	var ts []Token
+	if err := db.Model(&ts).Where("client_id = ?", clientId).Select(); err != nil {
+		return nil, err
+	}
+	return toAuthTokens(ts)
+}
+
+func toAuthTokens(ts []Token) ([]*auth.AuthToken, error) {
+	var authTokens []*auth.AuthToken
+	for _, t := range ts {
+		authToken, err := t.authToken()
+		if err != nil {
+			return nil, err
+		}
+		authTokens = append(authTokens, authToken)
+	}
+	return authTokens, nil
+}
+
+func (s *TokenStore) PurgeExpired(now time.Time) (int, error) {
+	res, err := db.Model(&Token{}).Where("expiration_time <= ?", now).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
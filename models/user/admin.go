@@ -0,0 +1,222 @@
+package user
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 50
+)
+
+// updateFields maps the paths that UpdateUser accepts in field masks to the columns that they update, and to a function
+// that validates the new value and adjusts the related ones.
+var updateFields = map[string]struct {
+	columns []string
+	apply   func(u *User) error
+}{
+	// Admins may only turn off TOTP, e.g., for users who lost their authenticators, and the secret goes with it.
+	"totpEnabled": {
+		columns: []string{"totp_enabled", "totp_secret", "recovery_codes"},
+		apply: func(u *User) error {
+			if u.TotpEnabled {
+				return status.Error(codes.InvalidArgument, "TOTP can only be enabled by the user")
+			}
+			u.TotpSecret = ""
+			u.RecoveryCodes = nil
+			return nil
+		},
+	},
+	"email": {
+		columns: []string{"email"},
+		apply:   func(u *User) error { return nil },
+	},
+	"displayName": {
+		columns: []string{"display_name"},
+		apply:   func(u *User) error { return nil },
+	},
+	"status": {
+		columns: []string{"status"},
+		apply: func(u *User) error {
+			if _, ok := Status_name[int32(u.Status)]; !ok {
+				return status.Error(codes.InvalidArgument, "Invalid status")
+			}
+			return nil
+		},
+	},
+}
+
+func (userService *UserService) UpdateUser(ctx context.Context, request *UpdateUserRequest) (*User, error) {
+	if request.User == nil || request.UpdateMask == nil || len(request.UpdateMask.Paths) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "User and update mask required")
+	}
+	u := *request.User
+	var columns []string
+	for _, path := range request.UpdateMask.Paths {
+		field, ok := updateFields[path]
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "Field cannot be updated: "+path)
+		}
+		if err := field.apply(&u); err != nil {
+			return nil, err
+		}
+		columns = append(columns, field.columns...)
+	}
+	u.UpdatedAt = time.Now().Unix()
+	columns = append(columns, "updated_at")
+
+	// Deleted users are not found, like they are everywhere else, until they are restored.
+	if res, err := db.Model(&u).Column(columns...).Where("id = ?", u.Id).Where("deleted_at IS NULL").Returning("*").
+		Update(); err != nil {
+		if _, ok := uniqueViolation(err); ok {
+			return nil, status.Error(codes.AlreadyExists, "Email already in use")
+		}
+		return nil, status.Error(codes.Internal, "Unable to update user")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	// Tokens of disabled users would otherwise remain usable until they expire.
+	if u.Status == Status_disabled {
+		if err := auth.RevokeUserTokens(u.Id); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to revoke tokens")
+		}
+	}
+	clearSecrets(&u)
+	return &u, nil
+}
+
+// DeleteUser only marks the user as deleted, so that it can be restored, and revokes the user's tokens. Deleted users
+// cannot log in, but their usernames remain taken.
+func (userService *UserService) DeleteUser(ctx context.Context, request *DeleteUserRequest) (*DeleteUserResponse, error) {
+	u := User{Id: request.Id, DeletedAt: time.Now().Unix()}
+	if res, err := db.Model(&u).Column("deleted_at").Where("id = ?", u.Id).Where("deleted_at IS NULL").Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to delete user")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "User not found")
+	}
+	if err := auth.RevokeUserTokens(request.Id); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to revoke tokens")
+	}
+	return &DeleteUserResponse{}, nil
+}
+
+func (userService *UserService) RestoreUser(ctx context.Context, request *RestoreUserRequest) (*User, error) {
+	u := User{Id: request.Id}
+	if res, err := db.Model(&u).Set("deleted_at = NULL").Where("id = ?", request.Id).Where("deleted_at IS NOT NULL").
+		Returning("*").Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to restore user")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "Deleted user not found")
+	}
+	clearSecrets(&u)
+	return &u, nil
+}
+
+// pageToken is the position after the last user of a page. It records the order as well, since the position is
+// meaningless in any other order.
+type pageToken struct {
+	OrderBy   string `json:"o"`
+	Id        string `json:"i"`
+	CreatedAt int64  `json:"c,omitempty"`
+}
+
+func encodePageToken(t *pageToken) string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(s string) (*pageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var t pageToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListUsers pages through users by keyset pagination, i.e., each page starts after the last user of the previous one,
+// so that users created or deleted in the meantime neither shift pages nor show up twice. Ties of the creation time are
+// broken by the id.
+func (userService *UserService) ListUsers(ctx context.Context, request *ListUsersRequest) (*ListUsersResponse, error) {
+	var users []*User
+	q := db.Model(&users)
+
+	orderBy := request.OrderBy
+	if orderBy == "" {
+		orderBy = "id"
+	}
+	direction, comparison := "ASC", ">"
+	field := orderBy
+	if strings.HasSuffix(orderBy, " desc") {
+		direction, comparison = "DESC", "<"
+		field = strings.TrimSuffix(orderBy, " desc")
+	}
+	switch field {
+	case "id":
+		q = q.Order("id " + direction)
+	case "createdAt":
+		q = q.Order("created_at "+direction, "id "+direction)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Invalid order: "+request.OrderBy)
+	}
+
+	if request.UsernamePrefix != "" {
+		q = q.Where(`id LIKE ? ESCAPE '\'`, escapeLike(request.UsernamePrefix)+"%")
+	}
+	if request.CreatedAfter != 0 {
+		q = q.Where("created_at >= ?", request.CreatedAfter)
+	}
+	if request.CreatedBefore != 0 {
+		q = q.Where("created_at < ?", request.CreatedBefore)
+	}
+	if !request.ShowDeleted {
+		q = q.Where("deleted_at IS NULL")
+	}
+
+	if request.PageToken != "" {
+		t, err := decodePageToken(request.PageToken)
+		if err != nil || t.OrderBy != orderBy {
+			return nil, status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		if field == "id" {
+			q = q.Where("id "+comparison+" ?", t.Id)
+		} else {
+			q = q.Where("(created_at, id) "+comparison+" (?, ?)", t.CreatedAt, t.Id)
+		}
+	}
+
+	pageSize := int(request.PageSize)
+	if pageSize == 0 {
+		pageSize = DEFAULT_PAGE_SIZE
+	}
+	// One more user than requested tells whether there is another page.
+	if err := q.Limit(pageSize + 1).Select(); err != nil && err != pg.ErrNoRows {
+		return nil, status.Error(codes.Internal, "Unable to fetch users")
+	}
+
+	var resp ListUsersResponse
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		last := users[pageSize-1]
+		resp.NextPageToken = encodePageToken(&pageToken{OrderBy: orderBy, Id: last.Id, CreatedAt: last.CreatedAt})
+	}
+	for _, u := range users {
+		clearSecrets(u)
+	}
+	resp.Users = users
+	return &resp, nil
+}
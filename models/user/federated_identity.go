@@ -0,0 +1,121 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// FederatedIdentity links an identity at the upstream OpenID provider to a user.
+type FederatedIdentity struct {
+	tableName struct{} `sql:"federated_identities,alias:federated_identity"`
+
+	Issuer  string `sql:",pk"`
+	Subject string `sql:",pk"`
+	UserId  string
+}
+
+func generateUsername() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "user-" + hex.EncodeToString(b), nil
+}
+
+// usernameCandidates prefers the username at the provider, and falls back to random ones if it is taken or too short.
+func usernameCandidates(identity *auth.FederatedIdentity) ([]string, error) {
+	var candidates []string
+	if len(identity.PreferredUsername) > 2 {
+		candidates = append(candidates, identity.PreferredUsername)
+	}
+	for i := 0; i < 3; i++ {
+		username, err := generateUsername()
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, username)
+	}
+	return candidates, nil
+}
+
+// errIdentityLinked rolls back the user that ProvisionFederatedUser created, when a concurrent request has linked the
+// identity in the meantime.
+var errIdentityLinked = errors.New("Identity linked concurrently")
+
+// ProvisionFederatedUser creates users without passwords, so that they can only log in through the provider. Concurrent
+// requests for the same identity all return the user that the first one created.
+func (h *UserStore) ProvisionFederatedUser(identity *auth.FederatedIdentity) (string, error) {
+	var userId string
+	link := FederatedIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Select(&link); err == nil {
+			userId = link.UserId
+			return nil
+		} else if err != pg.ErrNoRows {
+			return err
+		}
+
+		candidates, err := usernameCandidates(identity)
+		if err != nil {
+			return err
+		}
+		for _, username := range candidates {
+			now := time.Now().Unix()
+			u := User{Id: username, CreatedAt: now, UpdatedAt: now}
+			if res, err := tx.Model(&u).OnConflict("DO NOTHING").Insert(); err != nil {
+				return err
+			} else if res.RowsAffected() == 0 {
+				continue
+			}
+			link.UserId = username
+			if res, err := tx.Model(&link).OnConflict("DO NOTHING").Insert(); err != nil {
+				return err
+			} else if res.RowsAffected() == 0 {
+				return errIdentityLinked
+			}
+			userId = username
+			return nil
+		}
+		return errors.New("No username available")
+	})
+	if err == errIdentityLinked {
+		link = FederatedIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+		if err := db.Select(&link); err != nil {
+			return "", err
+		}
+		return link.UserId, nil
+	}
+	return userId, err
+}
+
+// LinkIdentity links the identity in an ID token of the upstream provider to the current user, who can then log in
+// through the provider as well.
+func (userService *UserService) LinkIdentity(ctx context.Context, request *LinkIdentityRequest) (*LinkIdentityResponse, error) {
+	token, _ := auth.GetAuthToken(ctx)
+	identity, err := auth.VerifyFederatedIdToken(request.IdToken)
+	if err == auth.ErrFederationDisabled {
+		return nil, status.Error(codes.Unimplemented, "Federated login is not configured")
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid ID token")
+	}
+
+	link := FederatedIdentity{Issuer: identity.Issuer, Subject: identity.Subject, UserId: token.UserId}
+	if res, err := db.Model(&link).OnConflict("DO NOTHING").Insert(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to link identity")
+	} else if res.RowsAffected() == 0 {
+		existing := FederatedIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+		if err := db.Select(&existing); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to link identity")
+		} else if existing.UserId != token.UserId {
+			return nil, status.Error(codes.AlreadyExists, "Identity linked to another user")
+		}
+	}
+	return &LinkIdentityResponse{Issuer: identity.Issuer, Subject: identity.Subject}, nil
+}
@@ -0,0 +1,60 @@
+package user
+
+import (
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/migration"
+	"os"
+	"sync"
+	"testing"
+)
+
+// requireDB skips tests that need Postgres unless POSTGRESQL_ADDRESS points at a server, whose schema is then brought up
+// to date.
+func requireDB(t *testing.T) {
+	if os.Getenv("POSTGRESQL_ADDRESS") == "" {
+		t.Skip("POSTGRESQL_ADDRESS not set")
+	}
+	if _, err := migration.Up(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisionFederatedUserConcurrently(t *testing.T) {
+	requireDB(t)
+	subject, err := generateUsername()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := &auth.FederatedIdentity{Issuer: "https://issuer.example.com", Subject: subject, PreferredUsername: subject}
+
+	const n = 10
+	var wg sync.WaitGroup
+	userIds := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userIds[i], errs[i] = (&UserStore{}).ProvisionFederatedUser(identity)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if userIds[i] != userIds[0] {
+			t.Errorf("provisioned both %s and %s", userIds[0], userIds[i])
+		}
+	}
+	link := FederatedIdentity{Issuer: identity.Issuer, Subject: identity.Subject}
+	if err := db.Select(&link); err != nil {
+		t.Fatal(err)
+	} else if link.UserId != userIds[0] {
+		t.Errorf("identity linked to %s instead of %s", link.UserId, userIds[0])
+	}
+	if _, err := db.Model(&User{}).Where("id = ?", userIds[0]).Delete(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"github.com/tfeng/postgres-grpc-example/notify"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/url"
+	"time"
+)
+
+const (
+	PASSWORD_RESET_EXPIRATION = time.Hour
+	PASSWORD_RESET_TICKET     = "password_reset"
+)
+
+func generateToken() (string, error) {
+	b := make([]byte, 33)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// setPassword replaces the password of the user, and revokes all of the user's tokens, which may have been obtained
+// with the old one.
+func setPassword(username string, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "Invalid password")
+	}
+	u := User{Id: username, HashedPassword: string(hashedPassword)}
+	if res, err := db.Model(&u).Column("hashed_password").Update(); err != nil {
+		return status.Error(codes.Internal, "Unable to update user")
+	} else if res.RowsAffected() == 0 {
+		return status.Error(codes.NotFound, "User not found")
+	}
+	if err := auth.RevokeUserTokens(username); err != nil {
+		return status.Error(codes.Internal, "Unable to revoke tokens")
+	}
+	return nil
+}
+
+// ChangePassword checks the current password like the password grant does, so incorrect ones count towards the lockout of
+// the user, and a stolen access token cannot be used to guess the password.
+func (userService *UserService) ChangePassword(ctx context.Context, request *ChangePasswordRequest) (*ChangePasswordResponse, error) {
+	token, _ := auth.GetAuthToken(ctx)
+	if err := auth.CheckLockout(ctx, token.UserId); err != nil {
+		return nil, err
+	}
+	u := User{Id: token.UserId}
+	if err := db.Select(&u); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.HashedPassword), []byte(request.CurrentPassword)); err != nil {
+		if err := auth.RecordLoginFailure(ctx, u.Id); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to record failure")
+		}
+		return nil, status.Error(codes.PermissionDenied, "Incorrect password")
+	}
+	if err := setPassword(u.Id, request.NewPassword); err != nil {
+		return nil, err
+	}
+	return &ChangePasswordResponse{}, nil
+}
+
+// RequestPasswordReset sends a reset token to the user through the notifier. It succeeds for unknown users, and users the
+// notifier has no address of, as well, so that it does not reveal which users exist.
+func (userService *UserService) RequestPasswordReset(ctx context.Context, request *RequestPasswordResetRequest) (*RequestPasswordResetResponse, error) {
+	u := User{Id: request.Username}
+	if err := db.Select(&u); err == pg.ErrNoRows || (err == nil && u.DeletedAt != 0) {
+		config.Logger.Info("Password reset requested for unknown user", zap.String("username", request.Username))
+		return &RequestPasswordResetResponse{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user")
+	}
+
+	resetToken, err := generateToken()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate reset token")
+	}
+	if err := userService.TicketStore.Put(PASSWORD_RESET_TICKET, resetToken, []byte(u.Id), time.Now().Add(PASSWORD_RESET_EXPIRATION)); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store reset token")
+	}
+
+	body := "Reset your password at " + config.PasswordResetUri + "?" + url.Values{"token": {resetToken}}.Encode() +
+		" within an hour. If you did not ask for a reset, you can ignore this message."
+	if err := userService.Notifier.Notify(u.Id, "Reset your password", body); err == notify.ErrNoAddress {
+		userService.TicketStore.Delete(PASSWORD_RESET_TICKET, resetToken)
+		config.Logger.Info("Password reset requested for user without address", zap.String("username", request.Username))
+	} else if err != nil {
+		userService.TicketStore.Delete(PASSWORD_RESET_TICKET, resetToken)
+		return nil, status.Error(codes.Internal, "Unable to send reset token")
+	}
+	return &RequestPasswordResetResponse{}, nil
+}
+
+// ConfirmPasswordReset takes the reset token, so that it can only be used once, and unlocks the user.
+func (userService *UserService) ConfirmPasswordReset(ctx context.Context, request *ConfirmPasswordResetRequest) (*ConfirmPasswordResetResponse, error) {
+	username, err := userService.TicketStore.Take(PASSWORD_RESET_TICKET, request.Token)
+	if err == auth.ErrTicketNotFound {
+		return nil, status.Error(codes.InvalidArgument, "Invalid reset token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch reset token")
+	}
+	if err := setPassword(string(username), request.NewPassword); err != nil {
+		return nil, err
+	}
+	if err := auth.UnlockUser(string(username)); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to unlock user")
+	}
+	return &ConfirmPasswordResetResponse{}, nil
+}
@@ -0,0 +1,192 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+const RECOVERY_CODE_COUNT = 10
+
+// generateRecoveryCode returns a random code in the form of xxxxx-xxxxx.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode ignores case and dashes, which users easily get wrong when typing codes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *UserStore) GetTotpSecret(username string) (string, error) {
+	u, err := h.getUser(username)
+	if err != nil {
+		return "", err
+	}
+	if !u.TotpEnabled {
+		return "", nil
+	}
+	return u.TotpSecret, nil
+}
+
+// UseRecoveryCode removes the code from the user in a transaction, so that concurrent requests cannot use it twice.
+func (h *UserStore) UseRecoveryCode(username string, code string) error {
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		u := User{Id: username}
+		if err := tx.Model(&u).Where("id = ?", username).For("UPDATE").Select(); err == pg.ErrNoRows {
+			return auth.ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if !u.TotpEnabled {
+			return auth.ErrIncorrectCode
+		}
+
+		hash := hashRecoveryCode(code)
+		for i, c := range u.RecoveryCodes {
+			if c == hash {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				_, err := tx.Model(&u).Column("recovery_codes").Update()
+				return err
+			}
+		}
+		return auth.ErrIncorrectCode
+	})
+}
+
+// EnrollTotp generates a new secret for the current user, which only takes effect once the user confirms it with a code.
+// Enrolling again before confirming replaces the secret. It requires the current password, so that a stolen access token
+// alone cannot enable a second factor the user does not have. Users with TOTP enabled must disable it, with a current code
+// or a recovery code, before they enroll again.
+func (userService *UserService) EnrollTotp(ctx context.Context, request *EnrollTotpRequest) (*EnrollTotpResponse, error) {
+	token, _ := auth.GetAuthToken(ctx)
+	if err := auth.CheckLockout(ctx, token.UserId); err != nil {
+		return nil, err
+	}
+	u := User{Id: token.UserId}
+	if err := db.Select(&u); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.HashedPassword), []byte(request.CurrentPassword)); err != nil {
+		if err := auth.RecordLoginFailure(ctx, u.Id); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to record failure")
+		}
+		return nil, status.Error(codes.PermissionDenied, "Incorrect password")
+	}
+	if u.TotpEnabled {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP already enabled")
+	}
+
+	secret, err := auth.GenerateTotpSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to generate secret")
+	}
+	u.TotpSecret = secret
+	if _, err := db.Model(&u).Column("totp_secret").Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to update user")
+	}
+
+	return &EnrollTotpResponse{Secret: secret, Uri: auth.TotpUri(config.TotpIssuer, u.Id, secret)}, nil
+}
+
+// ConfirmTotp enables TOTP for the current user, and returns the recovery codes, which are never shown again. Incorrect
+// codes count towards the lockout of the user, like failed logins.
+func (userService *UserService) ConfirmTotp(ctx context.Context, request *ConfirmTotpRequest) (*ConfirmTotpResponse, error) {
+	token, _ := auth.GetAuthToken(ctx)
+	if err := auth.CheckLockout(ctx, token.UserId); err != nil {
+		return nil, err
+	}
+	u := User{Id: token.UserId}
+	if err := db.Select(&u); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user")
+	}
+	if u.TotpEnabled {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP already enabled")
+	} else if u.TotpSecret == "" {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP not enrolled")
+	}
+	if err := auth.UseTotp(u.Id, u.TotpSecret, request.Otp, time.Now()); err == auth.ErrIncorrectCode {
+		if err := auth.RecordLoginFailure(ctx, u.Id); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to record failure")
+		}
+		return nil, status.Error(codes.InvalidArgument, "Incorrect code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to verify code")
+	}
+
+	var recoveryCodes []string
+	u.RecoveryCodes = nil
+	for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Unable to generate recovery codes")
+		}
+		recoveryCodes = append(recoveryCodes, code)
+		u.RecoveryCodes = append(u.RecoveryCodes, hashRecoveryCode(code))
+	}
+	u.TotpEnabled = true
+	if _, err := db.Model(&u).Column("totp_enabled", "recovery_codes").Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to update user")
+	}
+
+	return &ConfirmTotpResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTotp requires a current code or a recovery code, so that a stolen access token alone cannot turn off the second
+// factor. Incorrect codes count towards the lockout of the user, like failed logins.
+func (userService *UserService) DisableTotp(ctx context.Context, request *DisableTotpRequest) (*DisableTotpResponse, error) {
+	if (request.Otp == "") == (request.RecoveryCode == "") {
+		return nil, status.Error(codes.InvalidArgument, "Either a code or a recovery code required")
+	}
+	token, _ := auth.GetAuthToken(ctx)
+	if err := auth.CheckLockout(ctx, token.UserId); err != nil {
+		return nil, err
+	}
+	u := User{Id: token.UserId}
+	if err := db.Select(&u); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user")
+	}
+	if !u.TotpEnabled {
+		return nil, status.Error(codes.FailedPrecondition, "TOTP not enabled")
+	}
+
+	var err error
+	if request.RecoveryCode != "" {
+		err = (&UserStore{}).UseRecoveryCode(u.Id, request.RecoveryCode)
+	} else {
+		err = auth.UseTotp(u.Id, u.TotpSecret, request.Otp, time.Now())
+	}
+	if err == auth.ErrIncorrectCode {
+		if err := auth.RecordLoginFailure(ctx, u.Id); err != nil {
+			return nil, status.Error(codes.Internal, "Unable to record failure")
+		}
+		return nil, status.Error(codes.InvalidArgument, "Incorrect code")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to verify code")
+	}
+
+	u.TotpSecret = ""
+	u.TotpEnabled = false
+	u.RecoveryCodes = nil
+	if _, err := db.Model(&u).Column("totp_secret", "totp_enabled", "recovery_codes").Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to update user")
+	}
+
+	return &DisableTotpResponse{}, nil
+}
@@ -2,29 +2,114 @@ package user
 
 import (
 	"context"
+	"github.com/go-pg/pg"
 	"github.com/tfeng/postgres-grpc-example/auth"
 	"github.com/tfeng/postgres-grpc-example/config"
+	"github.com/tfeng/postgres-grpc-example/mail"
+	"github.com/tfeng/postgres-grpc-example/notify"
+	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"time"
 )
 
 var (
 	db = config.Db
 )
 
+// USERS_EMAIL_INDEX keeps emails unique, ignoring case. It is created by the create_users migration.
+const USERS_EMAIL_INDEX = "users_email_idx"
+
 type UserStore struct{}
 
-func (h *UserStore) GetUserInfo(username string) (*auth.UserInfo, error) {
+func (h *UserStore) getUser(username string) (*User, error) {
 	u := User{Id: username}
-	if err := db.Select(&u); err != nil {
-		return nil, status.Error(codes.InvalidArgument, "Unable to fetch user")
+	if err := db.Select(&u); err == pg.ErrNoRows || (err == nil && u.DeletedAt != 0) {
+		return nil, auth.ErrUserNotFound
+	} else if err != nil {
+		return nil, err
 	} else {
-		return &auth.UserInfo{u.HashedPassword, []auth.Scope{auth.Scope_user_profile}}, nil
+		return &u, nil
+	}
+}
+
+// GetEmail returns the email of the user, which is empty if the user has none, for notifiers that email users.
+func (h *UserStore) GetEmail(username string) (string, error) {
+	u, err := h.getUser(username)
+	if err != nil {
+		return "", err
+	}
+	return u.Email, nil
+}
+
+func userInfo(u *User) *auth.UserInfo {
+	return &auth.UserInfo{
+		Scope:       []auth.Scope{auth.Scope_user_profile},
+		MfaEnabled:  u.TotpEnabled,
+		Email:       u.Email,
+		DisplayName: u.DisplayName,
+	}
+}
+
+func (h *UserStore) GetUserInfo(username string) (*auth.UserInfo, error) {
+	u, err := h.getUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if u.Status == Status_disabled {
+		return nil, auth.ErrUserDisabled
+	}
+	return userInfo(u), nil
+}
+
+func (h *UserStore) Authenticate(username string, password string) (*auth.UserInfo, error) {
+	u, err := h.getUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.HashedPassword), []byte(password)); err != nil {
+		return nil, auth.ErrIncorrectPassword
+	}
+	// Only users who know the password learn that they are disabled or unverified.
+	if u.Status == Status_disabled {
+		return nil, auth.ErrUserDisabled
+	} else if u.Status == Status_pending_verification {
+		return nil, auth.ErrUserNotVerified
+	}
+	return userInfo(u), nil
+}
+
+func (h *UserStore) RecordLogin(username string, now time.Time) error {
+	u := User{Id: username, LastLoginAt: now.Unix()}
+	if res, err := db.Model(&u).Column("last_login_at").Update(); err != nil {
+		return err
+	} else if res.RowsAffected() == 0 {
+		return auth.ErrUserNotFound
+	}
+	return nil
+}
+
+// uniqueViolation returns the name of the unique constraint that the error violates, if any.
+func uniqueViolation(err error) (string, bool) {
+	if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23505" {
+		return pgErr.Field('n'), true
 	}
+	return "", false
 }
 
-type UserService struct{}
+// clearSecrets removes the credentials of the user before it is returned.
+func clearSecrets(u *User) {
+	u.HashedPassword = ""
+	u.TotpSecret = ""
+	u.RecoveryCodes = nil
+}
+
+type UserService struct {
+	Mailer      mail.Mailer      // Sends email verification tokens
+	Notifier    notify.Notifier  // Delivers password reset tokens
+	TicketStore auth.TicketStore // Keeps password reset and email verification tokens
+}
 
 func (userService *UserService) Create(ctx context.Context, request *CreateRequest) (*User, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
@@ -32,13 +117,31 @@ func (userService *UserService) Create(ctx context.Context, request *CreateReque
 		return nil, status.Error(codes.InvalidArgument, "Invalid password")
 	}
 
-	u := User{Id: request.Username, HashedPassword: string(hashedPassword)}
+	now := time.Now().Unix()
+	u := User{
+		Id:             request.Username,
+		HashedPassword: string(hashedPassword),
+		Email:          request.Email,
+		DisplayName:    request.DisplayName,
+		Status:         Status_pending_verification,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
 	if err := db.Insert(&u); err != nil {
+		if constraint, ok := uniqueViolation(err); ok && constraint == USERS_EMAIL_INDEX {
+			return nil, status.Error(codes.AlreadyExists, "Email already in use")
+		} else if ok {
+			return nil, status.Error(codes.AlreadyExists, "User already exists")
+		}
 		return nil, status.Error(codes.Internal, "Unable to create user")
-	} else {
-		u.HashedPassword = ""
-		return &u, nil
 	}
+	// The email is only sent once the user exists. If it cannot be sent, the user is still created, and the client can ask
+	// for another one with ResendVerification.
+	if err := userService.sendVerificationEmail(&u); err != nil {
+		config.Logger.Error("Unable to send verification email", zap.String("username", u.Id), zap.Error(err))
+	}
+	clearSecrets(&u)
+	return &u, nil
 }
 
 func (userService *UserService) Get(ctx context.Context, request *GetRequest) (*User, error) {
@@ -47,7 +150,15 @@ func (userService *UserService) Get(ctx context.Context, request *GetRequest) (*
 	if err := db.Select(&u); err != nil {
 		return nil, status.Error(codes.InvalidArgument, "Unable to fetch user")
 	} else {
-		u.HashedPassword = ""
+		clearSecrets(&u)
 		return &u, nil
 	}
 }
+
+// Unlock lifts the lockout of a user after failed logins. Lockouts of client addresses are left to expire.
+func (userService *UserService) Unlock(ctx context.Context, request *UnlockRequest) (*UnlockResponse, error) {
+	if err := auth.UnlockUser(request.Username); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to unlock user")
+	}
+	return &UnlockResponse{}, nil
+}
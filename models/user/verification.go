@@ -0,0 +1,83 @@
+package user
+
+import (
+	"context"
+	"github.com/go-pg/pg"
+	"github.com/tfeng/postgres-grpc-example/auth"
+	"github.com/tfeng/postgres-grpc-example/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/url"
+	"time"
+)
+
+const (
+	EMAIL_VERIFICATION_EXPIRATION      = time.Hour * 24
+	EMAIL_VERIFICATION_TICKET          = "email_verification"
+	EMAIL_VERIFICATION_RESEND_INTERVAL = time.Minute
+	EMAIL_VERIFICATION_RESENT_TICKET   = "email_verification_resent"
+)
+
+// sendVerificationEmail emails a token to the user, which proves that the user owns the email once it is sent back with
+// VerifyEmail. The token is deleted again if the email cannot be sent.
+func (userService *UserService) sendVerificationEmail(u *User) error {
+	verificationToken, err := generateToken()
+	if err != nil {
+		return status.Error(codes.Internal, "Unable to generate verification token")
+	}
+	if err := userService.TicketStore.Put(EMAIL_VERIFICATION_TICKET, verificationToken, []byte(u.Id), time.Now().Add(EMAIL_VERIFICATION_EXPIRATION)); err != nil {
+		return status.Error(codes.Internal, "Unable to store verification token")
+	}
+
+	body := "Verify your email at " + config.EmailVerificationUri + "?" + url.Values{"token": {verificationToken}}.Encode() +
+		" within a day to activate the account " + u.Id + "."
+	if err := userService.Mailer.Send(u.Email, "Verify your email", body); err != nil {
+		userService.TicketStore.Delete(EMAIL_VERIFICATION_TICKET, verificationToken)
+		return status.Error(codes.Internal, "Unable to send verification email")
+	}
+	return nil
+}
+
+// ResendVerification emails a new token to a user who is still pending verification, e.g., after the first one expired.
+// It succeeds for other users as well, so that it does not reveal which users exist, but sends at most one email to
+// each user per EMAIL_VERIFICATION_RESEND_INTERVAL.
+func (userService *UserService) ResendVerification(ctx context.Context, request *ResendVerificationRequest) (*ResendVerificationResponse, error) {
+	u := User{Id: request.Username}
+	if err := db.Select(&u); err == pg.ErrNoRows ||
+		(err == nil && (u.DeletedAt != 0 || u.Status != Status_pending_verification)) {
+		return &ResendVerificationResponse{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch user")
+	}
+
+	expirationTime := time.Now().Add(EMAIL_VERIFICATION_RESEND_INTERVAL)
+	if err := userService.TicketStore.Add(EMAIL_VERIFICATION_RESENT_TICKET, u.Id, nil, expirationTime); err == auth.ErrTicketExists {
+		return &ResendVerificationResponse{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to store verification token")
+	}
+	if err := userService.sendVerificationEmail(&u); err != nil {
+		return nil, err
+	}
+	return &ResendVerificationResponse{}, nil
+}
+
+// VerifyEmail activates the user that the token was sent to. The token is taken, so that it can only be used once.
+func (userService *UserService) VerifyEmail(ctx context.Context, request *VerifyEmailRequest) (*VerifyEmailResponse, error) {
+	username, err := userService.TicketStore.Take(EMAIL_VERIFICATION_TICKET, request.Token)
+	if err == auth.ErrTicketNotFound {
+		return nil, status.Error(codes.InvalidArgument, "Invalid verification token")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "Unable to fetch verification token")
+	}
+
+	// Users who have been disabled in the meantime stay disabled.
+	u := User{Id: string(username), Status: Status_active, UpdatedAt: time.Now().Unix()}
+	if res, err := db.Model(&u).Column("status", "updated_at").Where("id = ?", u.Id).
+		Where("status = ?", Status_pending_verification).Update(); err != nil {
+		return nil, status.Error(codes.Internal, "Unable to update user")
+	} else if res.RowsAffected() == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "User not pending verification")
+	}
+	return &VerifyEmailResponse{}, nil
+}
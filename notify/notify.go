@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tfeng/postgres-grpc-example/mail"
+	"go.uber.org/zap"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoAddress is returned for users whom a notifier has no address to deliver to.
+var ErrNoAddress = errors.New("No address to notify")
+
+// Notifier delivers messages to users, such as the tokens of password resets. Implementations that send emails or text
+// messages look up the addresses of users themselves.
+type Notifier interface {
+	Notify(username string, subject string, body string) error
+}
+
+// MailNotifier emails messages to users, at the addresses that Emails looks up by username.
+type MailNotifier struct {
+	Mailer mail.Mailer
+	Emails func(username string) (string, error)
+}
+
+func (n *MailNotifier) Notify(username string, subject string, body string) error {
+	email, err := n.Emails(username)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return ErrNoAddress
+	}
+	return n.Mailer.Send(email, subject, body)
+}
+
+// LogNotifier writes messages to the log, which stands in for an actual delivery during development.
+type LogNotifier struct {
+	Logger *zap.Logger
+}
+
+func (n *LogNotifier) Notify(username string, subject string, body string) error {
+	n.Logger.Info("Notification", zap.String("username", username), zap.String("subject", subject), zap.String("body", body))
+	return nil
+}
+
+// FileNotifier appends messages to a local file, from which tests and scripts can pick them up.
+type FileNotifier struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+func (n *FileNotifier) Notify(username string, subject string, body string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), username, subject, body)
+	return err
+}
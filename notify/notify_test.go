@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"errors"
+	"github.com/tfeng/postgres-grpc-example/mail"
+	"testing"
+)
+
+func TestMailNotifier(t *testing.T) {
+	errLookup := errors.New("Lookup failed")
+	emails := map[string]string{"alice": "alice@example.com", "bob": ""}
+	mailer := &mail.MemoryMailer{}
+	n := &MailNotifier{Mailer: mailer, Emails: func(username string) (string, error) {
+		if email, ok := emails[username]; ok {
+			return email, nil
+		}
+		return "", errLookup
+	}}
+
+	if err := n.Notify("alice", "Subject", "Body"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify("bob", "Subject", "Body"); err != ErrNoAddress {
+		t.Errorf("user without email: expected %v, got %v", ErrNoAddress, err)
+	}
+	if err := n.Notify("carol", "Subject", "Body"); err != errLookup {
+		t.Errorf("unknown user: expected %v, got %v", errLookup, err)
+	}
+
+	messages := mailer.Messages()
+	if len(messages) != 1 || messages[0] != (mail.Message{To: "alice@example.com", Subject: "Subject", Body: "Body"}) {
+		t.Errorf("unexpected messages %v", messages)
+	}
+}
@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"github.com/tfeng/postgres-grpc-example/auth"
 	"github.com/tfeng/postgres-grpc-example/models/user"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"io/ioutil"
 	"log"
+	"net/url"
+	"os"
+	"strings"
 )
 
 const (
@@ -16,14 +24,44 @@ const (
 	clientSecret = "password"
 	username     = "amy"
 	password     = "password"
+	email        = "amy@example.com"
 )
 
 var (
 	authClient, userClient = connect()
 )
 
+// transportOption connects with TLS if TLS_CA_FILE names the CA of the server certificate, and presents a client
+// certificate as well if TLS_CERT_FILE and TLS_KEY_FILE are given.
+func transportOption() (grpc.DialOption, error) {
+	caFile := os.Getenv("TLS_CA_FILE")
+	if caFile == "" {
+		return grpc.WithInsecure(), nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + caFile)
+	}
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("TLS_KEY_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
 func connect() (auth.AuthServiceClient, user.UserServiceClient) {
-	if conn, err := grpc.Dial(address, grpc.WithInsecure()); err != nil {
+	option, err := transportOption()
+	if err != nil {
+		panic(err)
+	}
+	if conn, err := grpc.Dial(address, option); err != nil {
 		panic(err)
 	} else {
 		return auth.NewAuthServiceClient(conn), user.NewUserServiceClient(conn)
@@ -33,7 +71,7 @@ func connect() (auth.AuthServiceClient, user.UserServiceClient) {
 func create(clientToken string) *user.User {
 	md := metadata.Pairs("authorization", "bearer "+clientToken)
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
-	request := user.CreateRequest{Username: username, Password: password}
+	request := user.CreateRequest{Username: username, Password: password, Email: email}
 	log.Println("create request", encode(request))
 	if user, err := userClient.Create(ctx, &request); err != nil {
 		panic(err)
@@ -43,6 +81,41 @@ func create(clientToken string) *user.User {
 	}
 }
 
+// readVerificationToken reads the token from the last verification email, which the server appends to MAILER_FILE when it
+// runs with MAILER=file.
+func readVerificationToken() string {
+	mailFile := os.Getenv("MAILER_FILE")
+	if mailFile == "" {
+		mailFile = "mail.txt"
+	}
+	data, err := ioutil.ReadFile(mailFile)
+	if err != nil {
+		panic(err)
+	}
+	mail := string(data)
+	i := strings.LastIndex(mail, "token=")
+	if i < 0 {
+		panic("No verification email in " + mailFile)
+	}
+	token := strings.Fields(mail[i+len("token="):])[0]
+	if token, err = url.QueryUnescape(token); err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func verifyEmail(clientToken string) {
+	md := metadata.Pairs("authorization", "bearer "+clientToken)
+	ctx := metadata.NewOutgoingContext(context.Background(), md)
+	request := user.VerifyEmailRequest{Token: readVerificationToken()}
+	log.Println("verify email request", encode(request))
+	if response, err := userClient.VerifyEmail(ctx, &request); err != nil {
+		panic(err)
+	} else {
+		log.Println("verify email response", encode(response))
+	}
+}
+
 func encode(obj interface{}) string {
 	if b, err := json.Marshal(obj); err != nil {
 		panic(err)
@@ -75,7 +148,7 @@ func authorizeClient() string {
 	}
 }
 
-func authorizeUser(clientToken string) string {
+func authorizeUser(clientToken string) (string, string) {
 	md := metadata.Pairs("authorization", "bearer "+clientToken)
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
 	request := auth.CreateTokenRequest{GrantType: "password", Username: username, Password: password}
@@ -84,6 +157,19 @@ func authorizeUser(clientToken string) string {
 		panic(err)
 	} else {
 		log.Println("authorize user response", encode(response))
+		return response.AccessToken, response.RefreshToken
+	}
+}
+
+func refreshUser(clientToken string, refreshToken string) string {
+	md := metadata.Pairs("authorization", "bearer "+clientToken)
+	ctx := metadata.NewOutgoingContext(context.Background(), md)
+	request := auth.CreateTokenRequest{GrantType: "refresh_token", RefreshToken: refreshToken}
+	log.Println("refresh user request", encode(request))
+	if response, err := authClient.CreateToken(ctx, &request); err != nil {
+		panic(err)
+	} else {
+		log.Println("refresh user response", encode(response))
 		return response.AccessToken
 	}
 }
@@ -91,6 +177,9 @@ func authorizeUser(clientToken string) string {
 func main() {
 	clientToken := authorizeClient()
 	create(clientToken)
-	userToken := authorizeUser(clientToken)
+	verifyEmail(clientToken)
+	userToken, refreshToken := authorizeUser(clientToken)
+	get(userToken)
+	userToken = refreshUser(clientToken, refreshToken)
 	get(userToken)
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"github.com/gorilla/mux"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
@@ -10,49 +13,135 @@ import (
 	"github.com/tfeng/postgres-grpc-example/auth"
 	"github.com/tfeng/postgres-grpc-example/config"
 	"github.com/tfeng/postgres-grpc-example/injection"
+	"github.com/tfeng/postgres-grpc-example/migration"
+	"github.com/tfeng/postgres-grpc-example/models/client"
 	"github.com/tfeng/postgres-grpc-example/models/user"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
+	"io/ioutil"
 	math_rand "math/rand"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-func createTable() error {
-	return db.CreateTable(&user.User{}, nil)
-}
+func initialize() {
+	math_rand.Seed(time.Now().UTC().UnixNano())
 
-func dropTable() error {
-	return db.DropTable(&user.User{}, nil)
-}
+	if config.MigrateOnStart {
+		if _, err := migrateUp(); err != nil {
+			logger.Fatal("Unable to migrate schema. ", zap.Error(err))
+			return
+		}
+	} else if pending, err := migration.Pending(db); err != nil {
+		logger.Fatal("Unable to check schema. ", zap.Error(err))
+		return
+	} else if pending {
+		logger.Fatal("Schema is not up to date. Run pg_server migrate up first.")
+		return
+	}
 
-func initialize() {
-	flag.Parse()
+	auth.SetTokenStore(injection.TokenStore)
+	auth.SetTicketStore(injection.TicketStore)
 
-	math_rand.Seed(time.Now().UTC().UnixNano())
+	defaultClientScope := []auth.Scope{auth.Scope_user_creation, auth.Scope_user_authorize, auth.Scope_token_introspection}
+	if err := client.EnsureClient(config.DefaultClientId, config.DefaultClientSecret, defaultClientScope); err != nil {
+		logger.Fatal("Unable to create default client. ", zap.Error(err))
+		return
+	}
+	if config.AdminClientSecret != "" {
+		adminClientScope := []auth.Scope{auth.Scope_client_admin, auth.Scope_client_registration}
+		if err := client.EnsureClient(config.AdminClientId, config.AdminClientSecret, adminClientScope); err != nil {
+			logger.Fatal("Unable to create admin client. ", zap.Error(err))
+			return
+		}
+	}
 
-	if err := dropTable(); err != nil {
-		logger.Info("Unable to drop table", zap.Error(err))
+	auth.SetKeyStore(injection.KeyStore)
+	if err := auth.RotateKeys(config.KeyRotationInterval); err != nil {
+		logger.Fatal("Unable to initialize signing keys. ", zap.Error(err))
+		return
+	}
+	if config.TokenFormat == "jwt" {
+		auth.EnableJWTAccessTokens()
+	}
+	auth.SetIssuer(config.Issuer)
+	if config.FederatedIssuer != "" {
+		auth.SetFederatedProvider(&auth.FederatedProvider{
+			Issuer:       config.FederatedIssuer,
+			Audience:     config.FederatedAudience,
+			JwksLocation: config.FederatedJwks,
+		})
 	}
+	auth.SetLockoutPolicy(auth.LockoutPolicy{
+		UserThreshold:    config.LockoutUserThreshold,
+		AddressThreshold: config.LockoutAddressThreshold,
+		BaseDelay:        config.LockoutBaseDelay,
+		MaxDelay:         config.LockoutMaxDelay,
+		Window:           config.LockoutWindow,
+	})
 
-	if err := createTable(); err != nil {
-		logger.Fatal("Unable to create table. ", zap.Error(err))
+	if scopes, err := auth.ParseScope(config.RegistrationScopes); err != nil {
+		logger.Fatal("Invalid registration scopes. ", zap.Error(err))
 		return
+	} else {
+		authService.RegistrationScopes = scopes
+	}
+}
+
+// loadTLSConfig returns nil if TLS is not configured. Client certificates are optional even with a client CA, so that
+// clients can still authenticate with their secrets.
+func loadTLSConfig() (*tls.Config, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if config.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + config.TLSClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
+	return tlsConfig, nil
 }
 
-func createGrpcService() *grpc.Server {
-	s := grpc.NewServer(grpc.StreamInterceptor(streamInterceptor), grpc.UnaryInterceptor(unaryInterceptor))
-	user.RegisterUserServiceServer(s, &user.UserService{})
-	auth.RegisterAuthServiceServer(s, &auth.AuthService{injection.GrantTypeHandlers})
+func createGrpcService(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.StreamInterceptor(streamInterceptor), grpc.UnaryInterceptor(unaryInterceptor)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	user.RegisterUserServiceServer(s, injection.UserService)
+	client.RegisterClientServiceServer(s, &client.ClientService{})
+	auth.RegisterAuthServiceServer(s, authService)
 	reflection.Register(s)
 	return s
 }
 
 var (
+	authService = &auth.AuthService{
+		GrantTypeHandlers:     injection.GrantTypeHandlers,
+		ClientStore:           injection.ClientStore,
+		ClientRegistry:        injection.ClientStore,
+		UserStore:             injection.UserStore,
+		DeviceVerificationUri: config.DeviceVerificationUri,
+		TokenEndpoint:         config.TokenEndpoint,
+	}
 	db                = config.Db
 	logger            = config.Logger
 	streamInterceptor = grpc_middleware.ChainStreamServer(
@@ -68,9 +157,23 @@ var (
 )
 
 func main() {
+	flag.Parse()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Arg(1)); err != nil {
+			logger.Fatal("Unable to migrate schema", zap.Error(err))
+		}
+		return
+	}
+
 	initialize()
 
-	s := createGrpcService()
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		logger.Fatal("Unable to load TLS configuration", zap.Error(err))
+		return
+	}
+
+	s := createGrpcService(tlsConfig)
 	listener, err := net.Listen("tcp", ":9090")
 	if err != nil {
 		logger.Fatal("Unable to start service", zap.Error(err))
@@ -78,18 +181,55 @@ func main() {
 	}
 	go s.Serve(listener)
 
+	janitor := auth.StartJanitor(config.TokenPurgeInterval)
+	keyRotation := auth.StartKeyRotation(config.KeyRotationInterval)
+
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	r := mux.NewRouter()
-	if ar, err := auth.CreateAuthServiceRouter(ctx, &auth.AuthService{injection.GrantTypeHandlers}, unaryInterceptor, s); err != nil {
+	if ar, err := auth.CreateAuthServiceRouter(ctx, authService, unaryInterceptor, s); err != nil {
 		logger.Fatal("Unable to create auth router", zap.Error(err))
-	} else if ur, err := user.CreateUserServiceRouter(ctx, &user.UserService{}, unaryInterceptor, s); err != nil {
+	} else if ur, err := user.CreateUserServiceRouter(ctx, injection.UserService, unaryInterceptor, s); err != nil {
 		logger.Fatal("Unable to create user router", zap.Error(err))
+	} else if cr, err := client.CreateClientServiceRouter(ctx, &client.ClientService{}, unaryInterceptor, s); err != nil {
+		logger.Fatal("Unable to create client router", zap.Error(err))
 	} else {
 		r.Handle("/oauth/{_dummy:.*}", ar)
+		r.Handle("/.well-known/{_dummy:.*}", ar)
 		r.Handle("/v1/users/{_dummy:.*}", ur)
-		http.ListenAndServe(":8080", r)
+		r.Handle("/v1/clients/{_dummy:.*}", cr)
+		server := &http.Server{Addr: ":8080", Handler: r, TLSConfig: tlsConfig}
+		done := make(chan struct{})
+		go shutdownOnSignal(server, s, []*auth.Janitor{janitor, keyRotation}, done)
+		if err := listenAndServe(server); err != http.ErrServerClosed {
+			logger.Fatal("Unable to start rest service", zap.Error(err))
+		}
+		<-done
+	}
+}
+
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// The certificate is already in the TLS configuration.
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+func shutdownOnSignal(server *http.Server, s *grpc.Server, janitors []*auth.Janitor, done chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	logger.Info("Shutting down")
+	if err := server.Shutdown(context.Background()); err != nil {
+		logger.Info("Unable to shut down rest service", zap.Error(err))
+	}
+	s.GracefulStop()
+	for _, janitor := range janitors {
+		janitor.Stop()
 	}
+	close(done)
 }
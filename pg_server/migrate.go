@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tfeng/postgres-grpc-example/migration"
+	"go.uber.org/zap"
+	"time"
+)
+
+func migrateUp() ([]*migration.Migration, error) {
+	applied, err := migration.Up(db)
+	for _, m := range applied {
+		logger.Info("Applied migration", zap.Int("version", m.Version), zap.String("name", m.Name))
+	}
+	return applied, err
+}
+
+// runMigrate implements "pg_server migrate up|down|status". Up applies all pending migrations, down reverts the latest
+// one, and status lists all of them.
+func runMigrate(command string) error {
+	switch command {
+	case "up":
+		applied, err := migrateUp()
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return err
+	case "down":
+		m, err := migration.Down(db)
+		if err == migration.ErrNothingToRevert {
+			fmt.Println("No migration to revert")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		logger.Info("Reverted migration", zap.Int("version", m.Version), zap.String("name", m.Name))
+		return nil
+	case "status":
+		statuses, err := migration.GetStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s  %s\n", s.Migration.Version, s.Migration.Name, appliedAt)
+		}
+		return nil
+	default:
+		return errors.New("Usage: pg_server migrate up|down|status")
+	}
+}
@@ -39,6 +39,7 @@ func Create{{$svc.Service.GetName}}Router(ctx context.Context, impl {{$svc.Servi
 	r := mux.NewRouter()
 	{{range $m := $svc.Methods}}
 	{{range $o := $m.HttpOpts}}
+	{{if $o.HasBody}}
 	r.HandleFunc({{$o.PathTemplate | printf "%q"}}, func(w http.ResponseWriter, r *http.Request) {
 		rest.HandleRequest(ctx, interceptor, s, w, r, &{{$m.InputType}}{}, func(ctx context.Context, req interface{}) (interface{}, error) {
 			return impl.{{$m.Method.GetName}}(ctx, req.(*{{$m.InputType}}))
@@ -48,6 +49,13 @@ func Create{{$svc.Service.GetName}}Router(ctx context.Context, impl {{$svc.Servi
 	r.HandleFunc({{$o.PathTemplate | printf "%q"}}, func(w http.ResponseWriter, r *http.Request) {
 		rest.HandleWrongContentType(ctx, w, r)
 	}).Methods({{$o.HttpMethod | printf "%q"}})
+	{{else}}
+	r.HandleFunc({{$o.PathTemplate | printf "%q"}}, func(w http.ResponseWriter, r *http.Request) {
+		rest.HandleRequest(ctx, interceptor, s, w, r, &{{$m.InputType}}{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return impl.{{$m.Method.GetName}}(ctx, req.(*{{$m.InputType}}))
+		})
+	}).Methods({{$o.HttpMethod | printf "%q"}})
+	{{end}}
 	{{end}}
 	{{end}}
 	return r, nil
@@ -58,6 +66,7 @@ func Create{{$svc.Service.GetName}}Router(ctx context.Context, impl {{$svc.Servi
 type HttpOpt struct {
 	HttpMethod   string
 	PathTemplate string
+	HasBody      bool // Requests without a body, e.g., GET, are accepted regardless of their content type
 }
 
 type Method struct {
@@ -151,13 +160,13 @@ func getHttpOpts(md *descriptor.MethodDescriptorProto) []*HttpOpt {
 			if httpMethod, pathTemplate, err := extractHttpRule(opts); err != nil {
 				glog.Fatal("unable to process http rule", err)
 			} else {
-				httpOpts = append(httpOpts, &HttpOpt{httpMethod, pathTemplate})
+				httpOpts = append(httpOpts, &HttpOpt{httpMethod, pathTemplate, opts.Body != ""})
 			}
 			for _, addOpts := range opts.AdditionalBindings {
 				if httpMethod, pathTemplate, err := extractHttpRule(addOpts); err != nil {
 					glog.Fatal("unable to process http rule", err)
 				} else {
-					httpOpts = append(httpOpts, &HttpOpt{httpMethod, pathTemplate})
+					httpOpts = append(httpOpts, &HttpOpt{httpMethod, pathTemplate, addOpts.Body != ""})
 				}
 			}
 		}
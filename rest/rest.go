@@ -1,15 +1,24 @@
 package rest
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -31,6 +40,61 @@ func extractHeaders(ctx context.Context, req *http.Request) context.Context {
 	return metadata.NewIncomingContext(ctx, md)
 }
 
+// extractPeer makes the client address and TLS state available to interceptors, as they are for gRPC requests.
+func extractPeer(ctx context.Context, req *http.Request) context.Context {
+	p := peer.Peer{}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+	if req.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *req.TLS}
+	}
+	return peer.NewContext(ctx, &p)
+}
+
+type errorBody struct {
+	Error   string            `json:"error"`
+	Code    int32             `json:"code"`
+	Details []json.RawMessage `json:"details,omitempty"`
+}
+
+// httpError is like runtime.HTTPError, but also writes the details of the status, such as the mfa token of an
+// mfa_required error, and the Retry-After header of lockouts.
+func httpError(ctx context.Context, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	s, ok := status.FromError(err)
+	if !ok || len(s.Proto().Details) == 0 {
+		runtime.HTTPError(ctx, marshaler, w, r, err)
+		return
+	}
+
+	body := errorBody{Error: s.Message(), Code: int32(s.Code())}
+	pbMarshaler := jsonpb.Marshaler{OrigName: true}
+	for _, detail := range s.Proto().Details {
+		var retryInfo errdetails.RetryInfo
+		if err := ptypes.UnmarshalAny(detail, &retryInfo); err == nil {
+			if d, err := ptypes.Duration(retryInfo.RetryDelay); err == nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())))
+			}
+		}
+		var buf bytes.Buffer
+		if err := pbMarshaler.Marshal(&buf, detail); err != nil {
+			glog.Error(err)
+			continue
+		}
+		body.Details = append(body.Details, buf.Bytes())
+	}
+	buf, merr := marshaler.Marshal(body)
+	if merr != nil {
+		glog.Error(merr)
+		runtime.HTTPError(ctx, marshaler, w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", marshaler.ContentType())
+	w.WriteHeader(runtime.HTTPStatusFromCode(s.Code()))
+	w.Write(buf)
+}
+
 type implFunc func(context.Context, interface{}) (interface{}, error)
 
 func HandleRequest(
@@ -58,6 +122,7 @@ func HandleRequest(
 	}
 
 	ctx = extractHeaders(ctx, r)
+	ctx = extractPeer(ctx, r)
 
 	marshaler := runtime.JSONBuiltin{}
 	if err := marshaler.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
@@ -76,7 +141,7 @@ func HandleRequest(
 		resp, err = interceptor(ctx, req, &grpc.UnaryServerInfo{Server: s, FullMethod: "CreateToken"}, handler)
 	}
 	if err != nil {
-		runtime.HTTPError(ctx, &marshaler, w, r, err)
+		httpError(ctx, &marshaler, w, r, err)
 		return
 	} else if buf, err := marshaler.Marshal(resp); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)